@@ -0,0 +1,387 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coyove/bbolt"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	roleAdmin     = "admin"     // Global admin
+	roleModerator = "moderator" // Moderator of listed channels
+
+	adminSessionAge = 3 * 86400
+	auditPage       = 200
+)
+
+// adminAccount is stored in the "admins" bucket keyed by account name.
+type adminAccount struct {
+	Name     string
+	PassHash []byte
+	Role     string
+	Channels []string
+	Created  int64
+}
+
+func (a adminAccount) marshal() (out []byte) {
+	out = binary.AppendVarint(out, a.Created)
+	out = appendString(out, string(a.PassHash))
+	out = appendString(out, a.Role)
+	for _, ch := range a.Channels {
+		out = appendString(out, ch)
+	}
+	return
+}
+
+func (a *adminAccount) unmarshal(k, v []byte) error {
+	a.Name = string(k)
+	r := reader{p: v}
+	a.Created = r.varint()
+	a.PassHash = append([]byte{}, r.bytes()...)
+	a.Role = string(r.bytes())
+	for r.err == nil && len(r.p) > 0 {
+		a.Channels = append(a.Channels, string(r.bytes()))
+	}
+	return r.err
+}
+
+func (a adminAccount) moderates(name string) bool {
+	if a.Role == roleAdmin {
+		return true
+	}
+	for _, ch := range a.Channels {
+		if ch == name {
+			return true
+		}
+	}
+	return false
+}
+
+// adminSession is stored in the "sessions" bucket keyed by the hash of the
+// token in the admin cookie, deleting it revokes the session.
+type adminSession struct {
+	Key     string
+	Account adminAccount
+	Expire  int64
+	Created int64
+	IP      string
+}
+
+func (s adminSession) marshal() (out []byte) {
+	out = appendString(out, s.Account.Name)
+	out = binary.AppendVarint(out, s.Expire)
+	out = binary.AppendVarint(out, s.Created)
+	out = appendString(out, s.IP)
+	return
+}
+
+func (s *adminSession) unmarshal(k, v []byte) error {
+	s.Key = string(k)
+	r := reader{p: v}
+	s.Account.Name = string(r.bytes())
+	s.Expire = r.varint()
+	s.Created = r.varint()
+	s.IP = string(r.bytes())
+	return r.err
+}
+
+func sessionKey(token string) []byte {
+	h := sha1.Sum([]byte(token))
+	return []byte(hex.EncodeToString(h[:]))
+}
+
+// initAdmins creates the root account with the -k key as its password when
+// there is no admin account.
+func initAdmins() error {
+	tx, err := world.store.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	bk, _ := tx.CreateBucketIfNotExists([]byte("admins"))
+	if k, _ := bk.Cursor().First(); len(k) > 0 {
+		return nil
+	}
+	hash, _ := bcrypt.GenerateFromPassword([]byte(*onlineKey), bcrypt.DefaultCost)
+	a := adminAccount{PassHash: hash, Role: roleAdmin, Created: time.Now().Unix()}
+	bk.Put([]byte("root"), a.marshal())
+	logrus.Infof("admin account 'root' created, password is the -k key, change it after login")
+	return tx.Commit()
+}
+
+// loadAdminSession returns the valid session of token with its account.
+func loadAdminSession(token string) (*adminSession, bool) {
+	tx, err := world.store.Begin(false)
+	if err != nil {
+		logrus.Errorf("load admin session: %v", err)
+		return nil, false
+	}
+	defer tx.Rollback()
+
+	bk, bkAdmins := tx.Bucket([]byte("sessions")), tx.Bucket([]byte("admins"))
+	if bk == nil || bkAdmins == nil {
+		return nil, false
+	}
+	k := sessionKey(token)
+	s := &adminSession{}
+	if v := bk.Get(k); len(v) == 0 || s.unmarshal(k, v) != nil || s.Expire < time.Now().Unix() {
+		return nil, false
+	}
+	name := []byte(s.Account.Name)
+	if v := bkAdmins.Get(name); len(v) == 0 || s.Account.unmarshal(name, v) != nil {
+		return nil, false
+	}
+	return s, true
+}
+
+func (c Ctx) isAdmin() bool {
+	return c.Admin != nil && c.Admin.Account.Role == roleAdmin
+}
+
+// audit records an action performed by an admin account or channel moderator.
+func (c Ctx) audit(format string, args ...any) {
+	who := c.Uid
+	if c.Admin != nil {
+		who = c.Admin.Account.Name + "(" + c.Admin.Account.Role + ")"
+	}
+	msg := fmt.Sprintf(format, args...)
+	logrus.Infof("audit: %s from %v: %s", who, c.IP, msg)
+
+	tx, err := world.store.Begin(true)
+	if err != nil {
+		logrus.Errorf("audit: %v", err)
+		return
+	}
+	defer tx.Rollback()
+	bk, _ := tx.CreateBucketIfNotExists([]byte("audit"))
+	seq, _ := bk.NextSequence()
+	v := binary.AppendVarint(nil, time.Now().Unix())
+	v = appendString(v, who)
+	v = appendString(v, c.IP.String())
+	v = appendString(v, msg)
+	bk.Put(binary.BigEndian.AppendUint64(nil, seq), v)
+	if err := tx.Commit(); err != nil {
+		logrus.Errorf("audit: %v", err)
+	}
+}
+
+func listAudit(n int) (res []map[string]any) {
+	tx, err := world.store.Begin(false)
+	if err != nil {
+		return nil
+	}
+	defer tx.Rollback()
+	if bk := tx.Bucket([]byte("audit")); bk != nil {
+		c := bk.Cursor()
+		for k, v := c.Last(); len(k) > 0 && len(res) < n; k, v = c.Prev() {
+			r := reader{p: v}
+			ts := r.varint()
+			who, ip, msg := string(r.bytes()), string(r.bytes()), string(r.bytes())
+			res = append(res, map[string]any{
+				"time": time.Unix(ts, 0).Format("2006-01-02 15:04:05"),
+				"who":  who,
+				"ip":   ip,
+				"msg":  msg,
+			})
+		}
+	}
+	return res
+}
+
+func listAdmins() (accounts []adminAccount, sessions []adminSession) {
+	tx, err := world.store.Begin(false)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	if bk := tx.Bucket([]byte("admins")); bk != nil {
+		bk.ForEach(func(k, v []byte) error {
+			a := adminAccount{}
+			if a.unmarshal(k, v) == nil {
+				accounts = append(accounts, a)
+			}
+			return nil
+		})
+	}
+	if bk := tx.Bucket([]byte("sessions")); bk != nil {
+		now := time.Now().Unix()
+		bk.ForEach(func(k, v []byte) error {
+			s := adminSession{}
+			if s.unmarshal(k, v) == nil && s.Expire > now {
+				sessions = append(sessions, s)
+			}
+			return nil
+		})
+	}
+	return
+}
+
+func updateAdmins(f func(admins, sessions *bbolt.Bucket) error) error {
+	tx, err := world.store.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	admins, _ := tx.CreateBucketIfNotExists([]byte("admins"))
+	sessions, _ := tx.CreateBucketIfNotExists([]byte("sessions"))
+	if err := f(admins, sessions); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func handleAdmin(c Ctx) {
+	var msg string
+	if c.Method == "POST" {
+		if validateToken(c, c.FormValue("token")) != 1 {
+			msg = "Invalid session"
+		} else {
+			msg = c.adminAction()
+		}
+		if msg == "" {
+			c.Redirect(302, "/~admin")
+			return
+		}
+	}
+
+	data := map[string]any{
+		"err":   msg,
+		"token": func() string { return makeToken(c) },
+	}
+	if c.Admin != nil {
+		data["me"] = c.Admin
+		if c.isAdmin() {
+			data["accounts"], data["sessions"] = listAdmins()
+			data["audit"] = listAudit(auditPage)
+		}
+	}
+	c.Template("admin.html", data)
+}
+
+// adminAction executes the posted action and returns the error message if any.
+func (c Ctx) adminAction() string {
+	name := sanitizeStrict(c.FormValue("name"), 20)
+	pass := c.FormValue("pass")
+	now := time.Now().Unix()
+
+	op := c.FormValue("op")
+	switch {
+	case op == "login":
+		cooling := !c.CheckIP("~admin")
+		c.AddIP("~admin", time.Second*3)
+		if cooling {
+			return "Cooling down"
+		}
+		var token string
+		err := updateAdmins(func(admins, sessions *bbolt.Bucket) error {
+			a := adminAccount{}
+			v := admins.Get([]byte(name))
+			if len(v) == 0 || a.unmarshal([]byte(name), v) != nil ||
+				bcrypt.CompareHashAndPassword(a.PassHash, []byte(pass)) != nil {
+				return fmt.Errorf("wrong account name or password")
+			}
+			expired := [][]byte{}
+			sessions.ForEach(func(k, v []byte) error {
+				if s := (adminSession{}); s.unmarshal(k, v) != nil || s.Expire < now {
+					expired = append(expired, k)
+				}
+				return nil
+			})
+			for _, k := range expired {
+				sessions.Delete(k)
+			}
+			token = hex.EncodeToString(randBytes(20))
+			s := adminSession{Account: a, Expire: now + adminSessionAge, Created: now, IP: c.IP.String()}
+			return sessions.Put(sessionKey(token), s.marshal())
+		})
+		if err != nil {
+			c.audit("failed login as %q", name)
+			return "Wrong account name or password"
+		}
+		http.SetCookie(c.ResponseWriter, &http.Cookie{
+			Name:     "admin",
+			Value:    token,
+			Expires:  time.Unix(now+adminSessionAge, 0),
+			HttpOnly: true,
+			Path:     "/",
+		})
+		c.Admin, _ = loadAdminSession(token)
+		c.audit("login")
+		return ""
+	case c.Admin == nil:
+		return "Login required"
+	case op == "logout":
+		updateAdmins(func(_, sessions *bbolt.Bucket) error {
+			return sessions.Delete([]byte(c.Admin.Key))
+		})
+		c.audit("logout")
+		return ""
+	case op == "password":
+		if len(pass) < 8 || len(pass) > 72 {
+			return "Password must be 8 to 72 bytes"
+		}
+		hash, _ := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+		updateAdmins(func(admins, _ *bbolt.Bucket) error {
+			a := c.Admin.Account
+			a.PassHash = hash
+			return admins.Put([]byte(a.Name), a.marshal())
+		})
+		c.audit("change password")
+		return ""
+	case !c.isAdmin():
+		return "Permission denied"
+	case op == "put":
+		a := adminAccount{Role: c.FormValue("role"), Created: now}
+		if a.Role != roleAdmin && a.Role != roleModerator {
+			return "Invalid role"
+		}
+		for _, ch := range strings.Fields(c.FormValue("channels")) {
+			if ch = sanitizeChannelName(ch); ch != "" {
+				a.Channels = append(a.Channels, ch)
+			}
+		}
+		err := updateAdmins(func(admins, _ *bbolt.Bucket) error {
+			if old := admins.Get([]byte(name)); len(old) > 0 {
+				tmp := adminAccount{}
+				tmp.unmarshal([]byte(name), old)
+				a.PassHash, a.Created = tmp.PassHash, tmp.Created
+			} else if len(pass) < 8 || len(pass) > 72 || name == "" {
+				return fmt.Errorf("password must be 8 to 72 bytes")
+			}
+			if pass != "" {
+				a.PassHash, _ = bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+			}
+			return admins.Put([]byte(name), a.marshal())
+		})
+		if err != nil {
+			return err.Error()
+		}
+		c.audit("put account %q role %s channels %v", name, a.Role, a.Channels)
+		return ""
+	case op == "delete":
+		if name == c.Admin.Account.Name {
+			return "Can't delete yourself"
+		}
+		updateAdmins(func(admins, _ *bbolt.Bucket) error {
+			return admins.Delete([]byte(name))
+		})
+		c.audit("delete account %q", name)
+		return ""
+	case op == "revoke":
+		key := c.FormValue("key")
+		updateAdmins(func(_, sessions *bbolt.Bucket) error {
+			return sessions.Delete([]byte(key))
+		})
+		c.audit("revoke session %.8s", key)
+		return ""
+	}
+	return "Unknown action"
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	apiMaxMessages = 200
+	apiSubBuffer   = 64
+)
+
+// Subscribe returns a channel receiving every message appended to ch, including
+// join, leave and ops. The channel is closed if the receiver falls behind.
+func (ch *Channel) Subscribe() chan Message {
+	sub := make(chan Message, apiSubBuffer)
+	ch.mu.Lock()
+	if ch.subs == nil {
+		ch.subs = map[chan Message]bool{}
+	}
+	ch.subs[sub] = true
+	ch.mu.Unlock()
+	return sub
+}
+
+func (ch *Channel) Unsubscribe(sub chan Message) {
+	ch.mu.Lock()
+	if ch.subs[sub] {
+		delete(ch.subs, sub)
+		close(sub)
+	}
+	ch.mu.Unlock()
+}
+
+func (ch *Channel) Subscribers() int {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	return len(ch.subs)
+}
+
+func (ch *Channel) publish(e Message) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	for sub := range ch.subs {
+		select {
+		case sub <- e:
+		default:
+			delete(ch.subs, sub)
+			close(sub)
+		}
+	}
+}
+
+// loadMessagesSince returns at most n stored messages after since in ascending
+// order, ops included. If since is 0, the latest n messages are returned.
+func loadMessagesSince(name string, since uint64, n int) (res []Message, err error) {
+	tx, err := world.store.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	bk := tx.Bucket([]byte("channel-" + name))
+	if bk == nil {
+		return nil, nil
+	}
+
+	c := bk.Cursor()
+	if since == 0 {
+		for k, v := c.Last(); len(k) > 0 && len(res) < n; k, v = c.Prev() {
+			m := Message{}
+			if err := m.Unmarshal(v); err != nil {
+				return nil, err
+			}
+			res = append(res, m)
+		}
+		for i, j := 0, len(res)-1; i < j; i, j = i+1, j-1 {
+			res[i], res[j] = res[j], res[i]
+		}
+		return res, nil
+	}
+
+	for k, v := c.Seek(binary.BigEndian.AppendUint64(nil, since+1)); len(k) > 0 && len(res) < n; k, v = c.Next() {
+		m := Message{}
+		if err := m.Unmarshal(v); err != nil {
+			return nil, err
+		}
+		res = append(res, m)
+	}
+	return res, nil
+}
+
+func handleAPI(c Ctx) {
+	name, action, _ := strings.Cut(strings.TrimPrefix(c.URL.Path, "/~api/"), "/")
+	if name = sanitizeChannelName(name); name == "" {
+		c.JSON(404, map[string]any{"error": "Channel not found"})
+		return
+	}
+	if msg := c.accessError(name); msg != "" {
+		c.JSON(403, map[string]any{"error": msg})
+		return
+	}
+
+	switch action {
+	case "messages":
+		c.apiMessages(name)
+	case "events":
+		c.apiEvents(name)
+	case "send":
+		c.apiSend(name)
+	default:
+		c.JSON(404, map[string]any{"error": "Unknown API"})
+	}
+}
+
+// apiMessages serves GET /~api/<channel>/messages?since=<id>&n=<count>. Clients
+// poll with the ID of the last message received as since.
+func (c Ctx) apiMessages(name string) {
+	since, _ := strconv.ParseUint(c.Query.Get("since"), 10, 64)
+	n, _ := strconv.Atoi(c.Query.Get("n"))
+	if n <= 0 || n > apiMaxMessages {
+		n = apiMaxMessages
+		if since == 0 {
+			n = screenMessages
+		}
+	}
+
+	res, err := loadMessagesSince(name, since, n)
+	if err != nil {
+		logrus.Errorf("[Channel %s] api messages: %v", name, err)
+		c.JSON(500, map[string]any{"error": "Internal error"})
+		return
+	}
+	if res == nil {
+		res = []Message{}
+	}
+	c.JSON(200, map[string]any{"channel": name, "messages": res})
+}
+
+// apiEvents serves GET /~api/<channel>/events as Server-Sent Events. Stored
+// messages after Last-Event-ID (or since) are replayed before live ones, join
+// and leave events have no ID as they are not stored.
+func (c Ctx) apiEvents(name string) {
+	flusher, _ := c.ResponseWriter.(http.Flusher)
+	if flusher == nil {
+		c.JSON(500, map[string]any{"error": "Streaming unsupported"})
+		return
+	}
+
+	ch, err := openChannel(name)
+	if err != nil {
+		logrus.Errorf("load channel: %v", err)
+		c.JSON(500, map[string]any{"error": "Internal error"})
+		return
+	}
+
+	sub := ch.Subscribe()
+	defer ch.Unsubscribe(sub)
+
+	since, _ := strconv.ParseUint(c.Request.Header.Get("Last-Event-ID"), 10, 64)
+	if since == 0 {
+		since, _ = strconv.ParseUint(c.Query.Get("since"), 10, 64)
+	}
+	var backlog []Message
+	if since > 0 {
+		if backlog, err = loadMessagesSince(name, since, apiMaxMessages); err != nil {
+			logrus.Errorf("[Channel %s] api events: %v", name, err)
+		}
+	}
+
+	c.ResponseWriter.Header().Set("Content-Type", "text/event-stream")
+	c.ResponseWriter.Header().Set("Cache-Control", "no-cache")
+	c.WriteHeader(200)
+
+	send := func(m Message) {
+		buf, _ := json.Marshal(m)
+		switch m.Type {
+		case MessageJoin, MessageLeave:
+			c.Printf("event: presence\ndata: %s\n\n", buf)
+		default:
+			c.Printf("id: %d\ndata: %s\n\n", m.ID, buf)
+		}
+		flusher.Flush()
+	}
+	for _, m := range backlog {
+		send(m)
+		since = m.ID
+	}
+	if len(backlog) == 0 {
+		c.Printf(": ok\n\n")
+		flusher.Flush()
+	}
+
+	keepalive := time.NewTicker(pingTimeout / 2)
+	defer keepalive.Stop()
+	for {
+		select {
+		case m, ok := <-sub:
+			if !ok {
+				return // Too slow or locked out, the client will reconnect with Last-Event-ID
+			}
+			if m.Type != MessageJoin && m.Type != MessageLeave && m.ID <= since {
+				continue
+			}
+			send(m)
+		case <-keepalive.C:
+			c.Printf(": ping\n\n")
+			flusher.Flush()
+		case <-c.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	botBurst    = 5           // Messages a bot can post at once
+	botInterval = time.Second // Time to regain one message
+	maxBots     = 10          // Bots per owner
+)
+
+// botRecord is stored in the "bots" bucket keyed by the bot name, the
+// "bottokens" bucket maps hashes of API tokens to bot names.
+type botRecord struct {
+	Name      string
+	Owner     string
+	TokenHash string
+	Created   int64
+}
+
+func (b botRecord) marshal() (out []byte) {
+	out = binary.AppendVarint(out, b.Created)
+	out = appendString(out, b.Owner)
+	out = appendString(out, b.TokenHash)
+	return
+}
+
+func (b *botRecord) unmarshal(k, v []byte) error {
+	b.Name = string(k)
+	r := reader{p: v}
+	b.Created = r.varint()
+	b.Owner = string(r.bytes())
+	b.TokenHash = string(r.bytes())
+	return r.err
+}
+
+func botTokenHash(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+func getBot(name string) (b botRecord, ok bool) {
+	tx, err := world.store.Begin(false)
+	if err != nil {
+		logrus.Errorf("get bot: %v", err)
+		return b, false
+	}
+	defer tx.Rollback()
+	if bk := tx.Bucket([]byte("bots")); bk != nil {
+		if v := bk.Get([]byte(name)); len(v) > 0 {
+			return b, b.unmarshal([]byte(name), v) == nil
+		}
+	}
+	return b, false
+}
+
+// findBotByToken returns the bot identified by the API token.
+func findBotByToken(token string) (b botRecord, ok bool) {
+	tx, err := world.store.Begin(false)
+	if err != nil {
+		logrus.Errorf("find bot: %v", err)
+		return b, false
+	}
+	defer tx.Rollback()
+	bkTokens, bk := tx.Bucket([]byte("bottokens")), tx.Bucket([]byte("bots"))
+	if bkTokens == nil || bk == nil {
+		return b, false
+	}
+	name := bkTokens.Get([]byte(botTokenHash(token)))
+	if v := bk.Get(name); len(name) > 0 && len(v) > 0 {
+		return b, b.unmarshal(name, v) == nil
+	}
+	return b, false
+}
+
+func listBots(owner string) (res []botRecord) {
+	tx, err := world.store.Begin(false)
+	if err != nil {
+		return nil
+	}
+	defer tx.Rollback()
+	if bk := tx.Bucket([]byte("bots")); bk != nil {
+		bk.ForEach(func(k, v []byte) error {
+			b := botRecord{}
+			if b.unmarshal(k, v) == nil && (owner == "" || b.Owner == owner) {
+				res = append(res, b)
+			}
+			return nil
+		})
+	}
+	return res
+}
+
+// putBot stores b with a new token, it fails if create is true and name has
+// been taken by a bot or a registered user.
+func putBot(b botRecord, create bool) (token string, ok bool, err error) {
+	tx, err := world.store.Begin(true)
+	if err != nil {
+		return "", false, err
+	}
+	defer tx.Rollback()
+	bk, _ := tx.CreateBucketIfNotExists([]byte("bots"))
+	bkTokens, _ := tx.CreateBucketIfNotExists([]byte("bottokens"))
+	if create {
+		if len(bk.Get([]byte(b.Name))) > 0 {
+			return "", false, nil
+		}
+		if users := tx.Bucket([]byte("users")); users != nil && len(users.Get([]byte(b.Name))) > 0 {
+			return "", false, nil
+		}
+	}
+	if b.TokenHash != "" {
+		bkTokens.Delete([]byte(b.TokenHash))
+	}
+	token = "bot-" + hex.EncodeToString(randBytes(24))
+	b.TokenHash = botTokenHash(token)
+	bkTokens.Put([]byte(b.TokenHash), []byte(b.Name))
+	bk.Put([]byte(b.Name), b.marshal())
+	return token, true, tx.Commit()
+}
+
+func deleteBot(b botRecord) error {
+	tx, err := world.store.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, name := range []string{"bots", "bottokens"} {
+		if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+			return err
+		}
+	}
+	tx.Bucket([]byte("bots")).Delete([]byte(b.Name))
+	tx.Bucket([]byte("bottokens")).Delete([]byte(b.TokenHash))
+	return tx.Commit()
+}
+
+var botLimiter struct {
+	sync.Mutex
+	next map[string]time.Time
+}
+
+// allowBot reports whether bot name can post now, bots can post botBurst
+// messages at once and then one message per botInterval.
+func allowBot(name string) bool {
+	botLimiter.Lock()
+	defer botLimiter.Unlock()
+	if botLimiter.next == nil {
+		botLimiter.next = map[string]time.Time{}
+	}
+	now := time.Now()
+	next := botLimiter.next[name]
+	if min := now.Add(-botInterval * (botBurst - 1)); next.Before(min) {
+		next = min
+	}
+	if next.After(now) {
+		return false
+	}
+	botLimiter.next[name] = next.Add(botInterval)
+	return true
+}
+
+// apiSend serves POST /~api/<channel>/send with an "Authorization: Bearer
+// <token>" header, the form value msg is posted as the bot.
+func (c Ctx) apiSend(name string) {
+	if c.Method != "POST" {
+		c.JSON(405, map[string]any{"error": "POST only"})
+		return
+	}
+	token, _ := strings.CutPrefix(c.Request.Header.Get("Authorization"), "Bearer ")
+	bot, ok := findBotByToken(token)
+	if !ok {
+		c.JSON(401, map[string]any{"error": "Invalid token"})
+		return
+	}
+	if !allowBot(bot.Name) {
+		c.JSON(429, map[string]any{"error": "Cooling down"})
+		return
+	}
+
+	c.Uid = bot.Name
+	if msg := c.accessError(name); msg != "" {
+		c.JSON(403, map[string]any{"error": msg})
+		return
+	}
+	if e, muted := checkMod(name, modMute, c.Uid, c.IP); muted {
+		c.JSON(403, map[string]any{"error": "Muted, remaining " + e.Remaining()})
+		return
+	}
+	if _, exists := getChannelInfo(name); !exists {
+		c.JSON(404, map[string]any{"error": "Channel not found"})
+		return
+	}
+
+	msg := sanitizeMessage(c.FormValue("msg"))
+	if msg == "" {
+		c.JSON(400, map[string]any{"error": "Empty message"})
+		return
+	}
+
+	ch, err := openChannel(name)
+	if err != nil {
+		logrus.Errorf("load channel: %v", err)
+		c.JSON(500, map[string]any{"error": "Internal error"})
+		return
+	}
+
+	var replyTo uint64
+	if ref, text, isReply := parseReply(msg); isReply {
+		if replyTo, isReply = ch.resolveReply(ref); isReply {
+			msg = text
+		}
+	}
+
+	m := Message{From: bot.Name, Type: MessageText, Text: msg, ReplyTo: replyTo, Flags: MessageBot}
+	if err := ch.Append(m); err != nil {
+		logrus.Errorf("append message: %v", err)
+		c.JSON(500, map[string]any{"error": "Internal error"})
+		return
+	}
+	ch.Refresh(-1)
+	c.JSON(200, map[string]any{"ok": true})
+}
+
+func handleBots(c Ctx) {
+	if !c.Verified() {
+		c.Redirect(302, "/~login")
+		return
+	}
+
+	var msg, token string
+	if c.Method == "POST" {
+		name := sanitizeStrict(c.FormValue("name"), 20)
+		b, exists := getBot(name)
+		var err error
+		switch op := c.FormValue("op"); {
+		case validateToken(c, c.FormValue("token")) != 1:
+			msg = "Invalid session"
+		case op == "create":
+			if len(name) < 2 {
+				msg = "Name too short"
+				break
+			}
+			if !c.isAdmin() && reservedName(name) {
+				msg = "Name reserved"
+				break
+			}
+			if len(listBots(c.User)) >= maxBots {
+				msg = "Too many bots"
+				break
+			}
+			var ok bool
+			token, ok, err = putBot(botRecord{Name: name, Owner: c.User, Created: time.Now().Unix()}, true)
+			if err == nil && !ok {
+				msg = "Name already taken"
+			}
+		case !exists || (b.Owner != c.User && !c.isAdmin()):
+			msg = "Bot not found"
+		case op == "regen":
+			token, _, err = putBot(b, false)
+		case op == "delete":
+			err = deleteBot(b)
+		}
+		if err != nil {
+			logrus.Errorf("bots %s: %v", name, err)
+			msg = "Internal error"
+		}
+		if msg == "" && token == "" {
+			c.Redirect(302, "/~bots")
+			return
+		}
+	}
+
+	owner := c.User
+	if c.isAdmin() {
+		owner = ""
+	}
+	c.Template("bots.html", map[string]any{
+		"user":     c.User,
+		"err":      msg,
+		"newToken": token,
+		"bots":     listBots(owner),
+		"token":    func() string { return makeToken(c) },
+	})
+}
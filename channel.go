@@ -7,7 +7,6 @@ import (
 	"hash/crc32"
 	"image"
 	"image/draw"
-	"image/jpeg"
 	"math/rand"
 	"net"
 	"net/http"
@@ -19,7 +18,6 @@ import (
 	"time"
 	"unicode/utf8"
 
-	"github.com/chai2010/webp"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/image/font"
 	"golang.org/x/image/math/fixed"
@@ -30,19 +28,22 @@ const (
 	autoRefresh = time.Second * 10
 )
 
-var screenHeight = 960
-var screenWidths = [...]int{400, 800}
+const screenMessages = 50
 
 type channelNotify struct {
 	data    []byte
-	jpeg    bool
+	tiles   []tile // Changed parts of the last frame, data is nil then
+	mime    string // Of data
 	kicked  bool
 	timeout bool
 }
 
 type channelOnline struct {
 	uid     string
-	si      int
+	pref    view // Preferred options, see view()
+	delta   bool // Accepts tiles, WebSocket only
+	shown   view // Of the last frame sent
+	synced  bool // Has received every frame or tile of shown
 	recv    chan channelNotify
 	ip      net.IP
 	joined  int64
@@ -55,7 +56,8 @@ type Channel struct {
 
 	mu sync.Mutex
 
-	lastImgData [2]channelNotify
+	frames      map[view]channelNotify // Encoded by the last refresh
+	rendered    map[view]*frame        // By the last refresh
 	onlines     map[string][]*channelOnline
 	links       []string
 	lastElapsed int64
@@ -65,9 +67,16 @@ type Channel struct {
 	nameHash    uint32
 	closed      bool
 	degradeJPEG bool
+	historySync bool
+	topic       string
+	description string
+	pins        []pin
+
+	subs map[chan Message]bool // API event streams
 
 	autoRefresh  *time.Timer
 	refreshThrot atomic.Int64
+	refreshMu    sync.Mutex // Tiles are diffed against the last refresh, one at a time
 }
 
 func loadChannel(name string) (*Channel, error) {
@@ -78,6 +87,9 @@ func loadChannel(name string) (*Channel, error) {
 	r.idctr = rand.Uint64()
 	r.autoRefresh = time.AfterFunc(autoRefresh, r.doAutoRefresh)
 	r.refreshThrot.Store(time.Now().Unix()) // 1 refresh per second
+	info, _ := getChannelInfo(name)
+	r.topic, r.description = info.Topic, info.Description
+	r.pins = loadPins(name)
 	r.Refresh(-1)
 
 	tx, err := world.store.Begin(false)
@@ -87,12 +99,17 @@ func loadChannel(name string) (*Channel, error) {
 	defer tx.Rollback()
 	if bk := tx.Bucket([]byte("channel-" + name)); bk != nil {
 		c := bk.Cursor()
-		for k, v := c.First(); len(k) > 0; k, v = c.Next() {
+		for k, v := c.Last(); len(k) > 0 && len(r.data) < screenMessages; k, v = c.Prev() {
 			m := Message{}
 			if err := m.Unmarshal(v); err != nil {
 				return nil, err
 			}
-			r.data = append(r.data, m)
+			if !m.IsOp() {
+				r.data = append(r.data, m)
+			}
+		}
+		for i, j := 0, len(r.data)-1; i < j; i, j = i+1, j-1 {
+			r.data[i], r.data[j] = r.data[j], r.data[i]
 		}
 	}
 	return r, nil
@@ -126,9 +143,14 @@ func (ch *Channel) Append(e Message) error {
 	e.ID = uint64(ch.Active-16e8)<<31 | uint64(ch.nameHash&0x7FFF)<<16 | (ch.idctr & 0xFFFF)
 	e.UnixTime = time.Now().Unix()
 
-	ch.data = append(ch.data, e)
-	if len(ch.data) > 50 {
-		ch.data = ch.data[1:]
+	if e.Type == MessageText {
+		e.Mentions = parseMentions(e.Text)
+	}
+	if !e.IsOp() {
+		ch.data = append(ch.data, e)
+		if len(ch.data) > screenMessages {
+			ch.data = ch.data[1:]
+		}
 	}
 
 	ch.mu.Unlock()
@@ -137,6 +159,8 @@ func (ch *Channel) Append(e Message) error {
 
 	switch e.Type {
 	case MessageJoin, MessageLeave:
+		ch.publish(e)
+		queueHooks(ch.Name, e)
 		return nil
 	}
 
@@ -147,25 +171,35 @@ func (ch *Channel) Append(e Message) error {
 	defer tx.Rollback()
 	bk, _ := tx.CreateBucketIfNotExists([]byte("channel-" + ch.Name))
 	bk.Put(binary.BigEndian.AppendUint64(nil, e.ID), e.Marshal())
-	if n, _ := bk.NextSequence(); n > 50 {
-		k, _ := bk.Cursor().First()
-		bk.Delete(k)
+	ch.trimHistory(bk)
+
+	var target Message
+	var pinned bool
+	if e.IsOp() {
+		if target, err = patchMessage(bk, e); err != nil {
+			return err
+		}
+		indexMessage(tx, ch.Name, target, false)
+		pinned = updatePin(tx, ch.Name, target)
+	} else {
+		indexMessage(tx, ch.Name, e, false)
+		recordMentions(tx, ch.Name, e)
 	}
 
-	bk, _ = tx.CreateBucketIfNotExists([]byte("channel"))
-	bkSort, _ := tx.CreateBucketIfNotExists([]byte("channelsort"))
+	putChannel(tx, ch.Name, ch.Active, nil)
 
-	namebuf := []byte(ch.Name)
-	timebuf := binary.BigEndian.AppendUint64(nil, uint64(ch.Active))
-	if old := bk.Get(namebuf); len(old) > 0 {
-		bkSort.Delete(append(old, namebuf...))
+	if err := tx.Commit(); err != nil {
+		return err
 	}
-	bkSort.Put(append(timebuf, namebuf...), nil)
-	if created, _ := bk.TestPut(namebuf, timebuf); created {
-		bk.NextSequence()
+	if e.IsOp() {
+		ch.replaceMessage(target)
 	}
-
-	return tx.Commit()
+	if pinned {
+		ch.reloadPins()
+	}
+	ch.publish(e)
+	queueHooks(ch.Name, e)
+	return nil
 }
 
 func (ch *Channel) Refresh(q int) {
@@ -181,27 +215,74 @@ func (ch *Channel) Refresh(q int) {
 		ch.autoRefresh.Reset(time.Second)
 		return
 	}
+	ch.refreshMu.Lock()
+	defer ch.refreshMu.Unlock()
 
-	var outs []channelNotify
-	for i, w := range screenWidths {
-		out := bytes.Buffer{}
-		if ch.lastElapsed > 600 || ch.degradeJPEG {
-			jpeg.Encode(&out, ch.render(i, w, screenHeight), &jpeg.Options{Quality: q})
-			ch.degradeJPEG = true
-		} else {
-			webp.Encode(&out, ch.render(i, w, screenHeight), &webp.Options{Quality: float32(q)})
+	ch.mu.Lock()
+	data, pinned := ch.data, len(ch.pins) > 0
+	frames := map[view]*frame{}
+	want := func(v view) *frame {
+		if frames[v] == nil {
+			frames[v] = &frame{}
+		}
+		return frames[v]
+	}
+	for _, w := range screenWidths {
+		want(view{width: w, scale: 1, theme: themeLight}).full = true // For new viewers
+	}
+	views := map[*channelOnline]view{}
+	for _, arr := range ch.onlines {
+		for _, waiter := range arr {
+			v := waiter.view(data, pinned)
+			if frames[v] == nil && len(frames) >= maxViews {
+				if v = v.plain(); frames[v] == nil {
+					v = view{width: screenWidths[0], scale: 1, theme: themeLight}
+				}
+			}
+			views[waiter] = v
+			if waiter.delta {
+				want(v).tiled = true
+			}
+			if waiter.delta && waiter.synced && waiter.shown == v && ch.rendered[v] != nil {
+				want(v).delta = true
+			} else {
+				want(v).full = true
+			}
 		}
-		outs = append(outs, channelNotify{data: out.Bytes(), jpeg: ch.degradeJPEG})
 	}
+	prev := ch.rendered
+	ch.mu.Unlock()
+
+	ch.renderViews(frames, prev, data, q)
 
 	ch.mu.Lock()
-	for i, note := range outs {
-		ch.traffic += int64(len(note.data))
-		ch.lastImgData[i] = note
+	ch.frames = map[view]channelNotify{}
+	ch.rendered = frames
+	for v, f := range frames {
+		ch.traffic += int64(len(f.note.data) + len(f.slide))
+		for _, t := range f.tiles {
+			ch.traffic += int64(len(t.data))
+		}
+		if len(f.note.data) > 0 {
+			ch.frames[v] = f.note
+		}
 	}
 
 	for _, arr := range ch.onlines {
 		for _, waiter := range arr {
+			v, ok := views[waiter]
+			if !ok { // Joined during rendering
+				v = waiter.view(data, pinned)
+			}
+			f := frames[v]
+			if f != nil && f.delta && !f.whole && waiter.delta && waiter.synced && waiter.shown == v {
+				// Tiles are queued behind older ones, the client needs all of them.
+				if len(f.tiles) > 0 {
+					waiter.send(v, channelNotify{tiles: f.tiles})
+				}
+				continue
+			}
+
 		EXHAUST:
 			select {
 			case note := <-waiter.recv:
@@ -213,69 +294,168 @@ func (ch *Channel) Refresh(q int) {
 			default:
 			}
 
-			select {
-			case waiter.recv <- channelNotify{data: outs[waiter.si].data}:
-			default:
+			note, ok := ch.frames[v]
+			if !ok {
+				v = waiter.pref.plain()
+				note, ok = ch.frames[v]
+			}
+			if f := frames[v]; ok && len(f.slide) > 0 && !waiter.delta && waiter.shown == v {
+				note.data = f.slide // Ends at the same frame
+			}
+			if ok {
+				waiter.send(v, note)
 			}
 		}
 	}
 
 	ch.lastElapsed = time.Since(start).Milliseconds()
+	switch { // Thresholds apart so it does not flip every refresh
+	case ch.lastElapsed > 600:
+		ch.degradeJPEG = true
+	case ch.lastElapsed < 200:
+		ch.degradeJPEG = false
+	}
 	ch.mu.Unlock()
 }
 
+// Join streams frames of ch to c until the client leaves, times out or is
+// kicked. Frames are sent as MJPEG, or as binary messages if c is a WebSocket
+// handshake.
 func (ch *Channel) Join(uid string, c Ctx) {
-	si, _ := strconv.Atoi(c.Query.Get("screen"))
-	if si == 800 {
-		si = 1
+	// Upgrade first, rejected handshakes must not show up as joins.
+	var ws *wsConn
+	if isWebSocket(c.Request) {
+		var err error
+		if ws, err = upgradeWebSocket(c); err != nil {
+			logrus.Errorf("websocket upgrade %v: %v", c.RemoteAddr, err)
+			if err == errWSOrigin {
+				c.WriteHeader(403)
+			} else {
+				c.WriteHeader(400)
+			}
+			return
+		}
+		defer ws.Close()
+	}
+
+	delta := ws != nil && c.Query.Get("delta") == "1"
+	state, switching := ch.register(uid, c.view(), delta, c.IP)
+	if state == nil {
+		msg := fmt.Sprintf("'%s' already exists in this channel", uid)
+		if ws != nil {
+			ws.writeLast(makeErrorImage(c.view(), msg))
+		} else {
+			c.writeErrorImage(msg)
+		}
+		logrus.Infof("[Channel %s] %s can't join due to same nickname %s", ch.Name, c.RemoteAddr, uid)
+		return
+	}
+
+	if !switching {
+		ch.Append(Message{From: uid, Type: MessageJoin})
+	}
+	ch.Refresh(-1)
+	if isDM(ch.Name) {
+		markDMRead(uid, ch.Name)
+		defer markDMRead(uid, ch.Name)
+	}
+	if c.Verified() {
+		clearMentions(uid, ch.Name)
+	}
+
+	var note channelNotify
+	if ws != nil {
+		note = ch.streamWebSocket(state, ws, c)
 	} else {
-		si = 0
+		note = ch.streamMJPEG(state, c)
 	}
+	ch.leave(state, note)
+}
 
+// register adds uid to the online list, replacing windows opened by the same IP.
+// It returns nil if uid is used by another IP.
+func (ch *Channel) register(uid string, pref view, delta bool, ip net.IP) (state *channelOnline, switching bool) {
 	ch.mu.Lock()
-	switching := false
+	defer ch.mu.Unlock()
+
 	if arr, ok := ch.onlines[uid]; ok {
-		if bytes.Equal(c.IP, arr[len(arr)-1].ip) {
-			for _, oldState := range arr {
-				oldState.recv <- channelNotify{
-					kicked: true,
-					data: makeErrorImage(screenWidths[oldState.si], screenHeight,
-						"Chat has been opened elsewhere"),
-				}
+		if !bytes.Equal(ip, arr[len(arr)-1].ip) {
+			return nil, false
+		}
+		for _, oldState := range arr {
+			oldState.recv <- channelNotify{
+				kicked: true,
+				data:   makeErrorImage(oldState.pref, "Chat has been opened elsewhere"),
+				mime:   "image/jpeg",
 			}
-			switching = true
-		} else {
-			ch.mu.Unlock()
-
-			c.ResponseWriter.Header().Add("Content-Type", "image/jpeg")
-			c.Write(makeErrorImage(screenWidths[si], screenHeight,
-				fmt.Sprintf("'%s' already exists in this channel", uid)))
-			logrus.Infof("[Channel %s] %s can't join due to same nickname %s", ch.Name, c.RemoteAddr, uid)
-			return
 		}
+		switching = true
 	}
-	state := &channelOnline{
+	state = &channelOnline{
 		uid:    uid,
-		ip:     c.IP,
-		si:     si,
+		ip:     ip,
+		pref:   pref,
+		delta:  delta,
 		recv:   make(chan channelNotify, 10),
 		joined: time.Now().Unix(),
 	}
 	ch.onlines[uid] = append(ch.onlines[uid], state)
 
-	if last := ch.lastImgData[si]; len(last.data) > 0 {
-		state.recv <- last
+	v := state.view(ch.data, len(ch.pins) > 0)
+	last, ok := ch.frames[v]
+	if !ok {
+		v = pref.plain()
+		last, ok = ch.frames[v]
+	}
+	if ok {
+		state.send(v, last)
 	}
 	state.timeout = time.AfterFunc(pingTimeout, func() {
 		state.recv <- channelNotify{timeout: true}
 	})
+	return state, switching
+}
+
+// send queues note of view v without blocking, a dropped frame or tile makes
+// o fall back to full frames.
+func (o *channelOnline) send(v view, note channelNotify) {
+	select {
+	case o.recv <- note:
+		o.shown, o.synced = v, true
+	default:
+		o.synced = false
+	}
+}
+
+func (ch *Channel) leave(state *channelOnline, note channelNotify) {
+	state.timeout.Stop()
+	if note.kicked {
+		logrus.Infof("[Channel %s] %s has switched window, old one lived %vs", ch.Name, state.uid, time.Now().Unix()-state.joined)
+	}
+	if note.timeout {
+		logrus.Infof("[Channel %s] %s has timed out, lived %vs", ch.Name, state.uid, time.Now().Unix()-state.joined)
+	}
+
+	ch.mu.Lock()
+	uid := state.uid
+	for i, w := range ch.onlines[uid] {
+		if w == state {
+			ch.onlines[uid] = append(ch.onlines[uid][:i], ch.onlines[uid][i+1:]...)
+			if len(ch.onlines[uid]) == 0 {
+				delete(ch.onlines, uid)
+			}
+			break
+		}
+	}
 	ch.mu.Unlock()
 
-	if !switching {
-		ch.Append(Message{From: uid, Type: MessageJoin})
+	if !note.kicked {
+		ch.Append(Message{From: uid, Type: MessageLeave})
 	}
 	ch.Refresh(-1)
+}
 
+func (ch *Channel) streamMJPEG(state *channelOnline, c Ctx) (note channelNotify) {
 	hijack, _ := c.ResponseWriter.(http.Hijacker)
 	if hijack == nil {
 		c.Write([]byte("bad protocol"))
@@ -295,87 +475,171 @@ func (ch *Channel) Join(uid string, c Ctx) {
 	// c.ResponseWriter.Header().Add("Content-Type", "multipart/x-mixed-replace; boundary=frame")
 	// c.WriteHeader(200)
 
-	var note channelNotify
-RECV:
 	for note = range state.recv {
 		for i := 0; i < 4; i++ {
 			conn.SetWriteDeadline(time.Now().Add(time.Second * 5))
-			if note.jpeg {
-				conn.Write([]byte("\r\n--frame\r\nContent-Type: image/jpeg\r\n\r\n"))
-			} else {
-				conn.Write([]byte("\r\n--frame\r\nContent-Type: image/webp\r\n\r\n"))
-			}
+			conn.Write([]byte("\r\n--frame\r\nContent-Type: " + note.mime + "\r\n\r\n"))
 			if _, err := conn.Write(note.data); err != nil {
 				logrus.Errorf("stream image data to %v: %v", c.RemoteAddr, err)
-				break RECV
+				return channelNotify{}
 			}
 		}
-		if note.kicked {
-			logrus.Infof("[Channel %s] %s has switched window, old one lived %vs", ch.Name, uid, time.Now().Unix()-state.joined)
-			break
-		}
-		if note.timeout {
-			logrus.Infof("[Channel %s] %s has timed out, lived %vs", ch.Name, uid, time.Now().Unix()-state.joined)
+		if note.kicked || note.timeout {
 			break
 		}
 	}
+	return note
+}
 
-	ch.mu.Lock()
-	for i, w := range ch.onlines[uid] {
-		if w == state {
-			ch.onlines[uid] = append(ch.onlines[uid][:i], ch.onlines[uid][i+1:]...)
-			if len(ch.onlines[uid]) == 0 {
-				delete(ch.onlines, uid)
+// streamWebSocket sends each frame once as a binary message. Refresh only keeps
+// the latest pending frame in state.recv, so a slow client skips frames instead
+// of queuing them. Pings from the server are answered by browsers automatically,
+// pongs and pings from the client keep the connection alive.
+// Delta clients get tiles too, see tileMessage.
+func (ch *Channel) streamWebSocket(state *channelOnline, ws *wsConn, c Ctx) channelNotify {
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			op, p, err := ws.ReadFrame()
+			if err != nil {
+				return
+			}
+			switch op {
+			case wsClose:
+				ws.WriteFrame(wsClose, p)
+				return
+			case wsPing:
+				ws.WriteFrame(wsPong, p)
+				state.timeout.Reset(pingTimeout)
+			case wsPong:
+				state.timeout.Reset(pingTimeout)
 			}
-			break
 		}
-	}
-	ch.mu.Unlock()
+	}()
 
-	if !note.kicked {
-		ch.Append(Message{From: uid, Type: MessageLeave})
+	ping := time.NewTicker(pingTimeout / 3)
+	defer ping.Stop()
+
+	for {
+		select {
+		case note := <-state.recv:
+			var err error
+			switch {
+			case state.delta:
+				if len(note.data) > 0 {
+					err = ws.WriteFrame(wsBinary, tileMessage(0, note.data))
+				}
+				for _, t := range note.tiles {
+					if err == nil {
+						err = ws.WriteFrame(wsBinary, tileMessage(t.y, t.data))
+					}
+				}
+			case len(note.data) > 0:
+				err = ws.WriteFrame(wsBinary, note.data)
+			}
+			if err != nil {
+				logrus.Errorf("stream image data to %v: %v", c.RemoteAddr, err)
+				return channelNotify{}
+			}
+			if note.kicked || note.timeout {
+				ws.WriteFrame(wsClose, nil)
+				return note
+			}
+		case <-ping.C:
+			ws.WriteFrame(wsPing, nil)
+		case <-closed:
+			return channelNotify{}
+		}
 	}
-	ch.Refresh(-1)
 }
 
-func (ch *Channel) render(si, w, h int) (img *image.RGBA) {
+// render draws data from bottom up as seen in v, data[top] is the oldest
+// message that fits on screen entirely.
+func (ch *Channel) render(v view, data []Message) (img *image.RGBA, top int) {
+	s := v.scale // Pixel sizes below are multiplied by s
+	w, h := v.width*s, screenHeight*s
 	img = image.NewRGBA(image.Rect(0, 0, w, h))
-	face := facePool.Get().(font.Face)
+	top = len(data)
+	face := getFace(s)
 
 	defer func() {
 		if r := recover(); r != nil {
 			logrus.Errorf("%v: %s", r, debug.Stack())
 		}
-		facePool.Put(face)
+		putFace(face)
 	}()
 
-	draw.Draw(img, img.Bounds(), image.White, image.Pt(0, 0), draw.Src)
+	t := v.theme
+	draw.Draw(img, img.Bounds(), t.bg, image.Pt(0, 0), draw.Src)
 
-	d := &font.Drawer{Dst: img, Src: image.Black, Face: face}
-	dg := &font.Drawer{Dst: img, Src: gray[3], Face: face}
-	du := &font.Drawer{Dst: img, Src: blue, Face: face}
+	d := &font.Drawer{Dst: img, Src: t.text, Face: face}
+	dg := &font.Drawer{Dst: img, Src: t.dim, Face: face}
+	du := &font.Drawer{Dst: img, Src: t.nick, Face: face}
 
-	const margin = 4
-	const contentLeft = margin * 2.5
+	lineHeight := lineHeight * s
+	margin := 4 * s
+	contentLeft := margin * 5 / 2
 
 	// m := face.Metrics()
 	// descent := m.Descent.Round()
 	barHeight := lineHeight * 3 / 2
 
 	y := h - margin*2 - barHeight
+	now := inZone(time.Now().Unix(), v.loc)
 
 	ch.mu.Lock()
-	data := ch.data
-	for uid, arr := range ch.onlines {
-		if len(arr) != 1 {
-			logrus.Infof("[Channel %s] multiple nickname %s", ch.Name, uid)
+	topic, description, pins := ch.topic, ch.description, ch.pins
+	lastSize := len(ch.frames[v].data)
+	ch.mu.Unlock()
+	var band, strip int
+	if topic != "" {
+		band = lineHeight + margin*3
+		if description != "" {
+			band += lineHeight
+		}
+	}
+	if !v.history && len(pins) > 0 {
+		strip = lineHeight + margin*3
+		if !v.collapsed {
+			strip += lineHeight
 		}
 	}
-	ch.mu.Unlock()
+
+	if !v.history {
+		ch.mu.Lock()
+		for uid, arr := range ch.onlines {
+			if len(arr) != 1 {
+				logrus.Infof("[Channel %s] multiple nickname %s", ch.Name, uid)
+			}
+		}
+		ch.mu.Unlock()
+	}
 
 	type elem struct {
-		text string
-		gray bool
+		text  string
+		gray  bool
+		dim   bool
+		quote bool
+	}
+
+	var parents map[uint64]Message
+	findParent := func(id uint64) (Message, bool) {
+		if parents == nil {
+			parents = map[uint64]Message{}
+			for _, m := range data {
+				parents[m.ID] = m
+			}
+		}
+		m, ok := parents[id]
+		if !ok {
+			m, ok = findMessage(ch.Name, id)
+			if !ok {
+				m.ID = id
+			}
+			parents[id] = m
+		}
+		return m, ok && m.From != ""
 	}
 
 	type overlay struct {
@@ -394,9 +658,9 @@ func (ch *Channel) render(si, w, h int) (img *image.RGBA) {
 		case MessageJoin, MessageLeave:
 			var msg string
 			if message.Type == MessageJoin {
-				msg = time.Unix(message.UnixTime, 0).Format(" joined at 15:04")
+				msg = inZone(message.UnixTime, v.loc).Format(" joined at 15:04")
 			} else {
-				msg = time.Unix(message.UnixTime, 0).Format(" left at 15:04")
+				msg = inZone(message.UnixTime, v.loc).Format(" left at 15:04")
 			}
 
 			du.Dot.X = fixed.I((w - du.MeasureString(message.From).Round() - d.MeasureString(msg).Round()) / 2)
@@ -406,10 +670,31 @@ func (ch *Channel) render(si, w, h int) (img *image.RGBA) {
 			d.DrawString(msg)
 			y -= lineHeight * 5 / 4
 			continue
+		case MessageSystem:
+			msg := " " + strings.Replace(message.Text, "\n", " ", -1)
+			msg = truncateText(d, msg, fixed.I(w-margin*4)-du.MeasureString(message.From))
+
+			du.Dot.X = fixed.I((w - du.MeasureString(message.From).Round() - d.MeasureString(msg).Round()) / 2)
+			du.Dot.Y = fixed.I(y)
+			du.DrawString(message.From)
+			d.Dot = du.Dot
+			DrawStringOmitEmojis(d, msg)
+			y -= lineHeight * 5 / 4
+			continue
 		}
 
 		var lines []elem
 		var overlays []overlay
+		if message.ReplyTo != 0 {
+			parent, ok := findParent(message.ReplyTo)
+			lines = append(lines, elem{
+				text:  quoteText(dg, parent, ok, fixed.I(w-contentLeft*2-margin*2)),
+				quote: true,
+			})
+		}
+		if message.Flags&MessageDeleted != 0 {
+			lines = append(lines, elem{text: "message deleted", dim: true})
+		}
 		for msg := strings.Replace(message.Text, "\t", "  ", -1); len(msg) > 0; {
 			var line string
 			line, msg, _ = strings.Cut(msg, "\n")
@@ -452,10 +737,10 @@ func (ch *Channel) render(si, w, h int) (img *image.RGBA) {
 						srcX: cand.x,
 						srcY: cand.y,
 					})
-					x += fixed.I(emojiAdvance)
+					x += fixed.I(emojiAdvance * s)
 					i += len(cand.text)
 				} else if _, _, ok := d.Face.GlyphBounds(c); !ok && c < 0x10000 {
-					x += fixed.I(18)
+					x += fixed.I(18 * s)
 				} else {
 					advance, _ := d.Face.GlyphAdvance(c)
 					x += advance
@@ -483,8 +768,11 @@ func (ch *Channel) render(si, w, h int) (img *image.RGBA) {
 
 		y -= len(lines)*lineHeight - lineHeight
 
-		if i%2 == 0 {
-			draw.Draw(img, image.Rect(0, y-lineHeight*2, w, y+len(lines)*lineHeight-lineHeight*5/8), gray[1], image.ZP, draw.Src)
+		if v.me != "" && contains(message.Mentions, v.me) {
+			draw.Draw(img, image.Rect(0, y-lineHeight*2, w, y+len(lines)*lineHeight-lineHeight*5/8), t.highlight, image.ZP, draw.Src)
+			draw.Draw(img, image.Rect(0, y-lineHeight*2, margin/2, y+len(lines)*lineHeight-lineHeight*5/8), t.bar2, image.ZP, draw.Src)
+		} else if i%2 == 0 {
+			draw.Draw(img, image.Rect(0, y-lineHeight*2, w, y+len(lines)*lineHeight-lineHeight*5/8), t.row, image.ZP, draw.Src)
 		}
 
 		for i, el := range lines {
@@ -492,10 +780,20 @@ func (ch *Channel) render(si, w, h int) (img *image.RGBA) {
 				dg.Dot.X = fixed.I(w) - dg.MeasureString(el.text) - fixed.I(contentLeft)
 				dg.Dot.Y = fixed.I(y + i*lineHeight)
 				dg.DrawString(el.text)
+			} else if el.dim {
+				dg.Dot.X = fixed.I(contentLeft)
+				dg.Dot.Y = fixed.I(y + i*lineHeight)
+				dg.DrawString(el.text)
+			} else if el.quote {
+				yy := y + i*lineHeight
+				draw.Draw(img, image.Rect(contentLeft, yy-lineHeight+6*s, contentLeft+2*s, yy+4*s), t.rule, image.ZP, draw.Src)
+				dg.Dot.X = fixed.I(contentLeft + margin*2)
+				dg.Dot.Y = fixed.I(yy)
+				DrawStringOmitEmojis(dg, el.text)
 			} else {
 				d.Dot.X = fixed.I(contentLeft)
 				d.Dot.Y = fixed.I(y + i*lineHeight)
-				DrawStringOmitEmojis(d, el.text)
+				drawMentions(d, du, el.text, message.Mentions)
 			}
 		}
 
@@ -505,18 +803,19 @@ func (ch *Channel) render(si, w, h int) (img *image.RGBA) {
 			switch el.typ {
 			case 'l':
 				msg := strconv.FormatInt(int64(el.srcX), 16)
-				draw.Draw(img, image.Rect(xx, yy+4,
-					xx+w, yy+h), badgeIcon, image.ZP, draw.Over)
+				bw := badgeIcon.Bounds().Dx() * s
+				drawScaled(img, image.Rect(xx, yy+4*s, xx+bw, yy+4*s+badgeIcon.Bounds().Dy()*s),
+					badgeIcon, badgeIcon.Bounds())
 				d.Src = image.White
-				d.Dot.X = fixed.I(xx + (badgeIcon.Bounds().Dx()-d.MeasureString(msg).Round())/2)
+				d.Dot.X = fixed.I(xx + (bw-d.MeasureString(msg).Round())/2)
 				d.Dot.Y = fixed.I(yy + lineHeight)
 				d.DrawString(msg)
-				d.Src = image.Black
+				d.Src = t.text
 			case 'e':
-				xx = xx + (emojiAdvance-emojiDim)/2
-				yy = yy + 4
-				draw.Draw(img, image.Rect(xx, yy, xx+emojiDim, yy+emojiDim),
-					emojiImage, image.Pt(el.srcX, el.srcY), draw.Over)
+				xx = xx + (emojiAdvance-emojiDim)*s/2
+				yy = yy + 4*s
+				drawScaled(img, image.Rect(xx, yy, xx+emojiDim*s, yy+emojiDim*s),
+					emojiImage, image.Rect(el.srcX, el.srcY, el.srcX+emojiDim, el.srcY+emojiDim))
 			}
 		}
 
@@ -525,52 +824,127 @@ func (ch *Channel) render(si, w, h int) (img *image.RGBA) {
 		du.Dot.X = fixed.I(margin)
 		du.Dot.Y = fixed.I(y)
 		du.DrawString(message.From)
+		if message.Flags&MessageVerified != 0 {
+			DrawStringOmitEmojis(du, "\u2713")
+		}
+		if message.Flags&MessageBot != 0 {
+			x := du.Dot.X + fixed.I(margin)
+			tw := dg.MeasureString("bot")
+			draw.Draw(img, image.Rect(x.Round()-2*s, y-lineHeight*3/4, (x+tw).Round()+2*s, y+lineHeight/4), t.shade, image.Point{}, draw.Src)
+			dg.Dot = fixed.Point26_6{X: x, Y: fixed.I(y)}
+			dg.DrawString("bot")
+			du.Dot.X = dg.Dot.X
+		}
 
-		d.Dot.X = fixed.I(margin + du.MeasureString(message.From).Round() + margin*2)
+		d.Dot.X = du.Dot.X + fixed.I(margin*2)
 		d.Dot.Y = fixed.I(y)
-		t := time.Unix(message.UnixTime, 0)
-		if t.YearDay() != time.Now().YearDay() {
-			d.DrawString(t.Format("01-02 15:04"))
+		at := inZone(message.UnixTime, v.loc)
+		if at.Format("20060102") != now.Format("20060102") {
+			d.DrawString(at.Format("01-02 15:04"))
 		} else {
-			d.DrawString(t.Format("15:04:05"))
+			d.DrawString(at.Format("15:04:05"))
 		}
+		if message.EditTime > 0 && message.Flags&MessageDeleted == 0 {
+			dg.Dot = d.Dot
+			dg.DrawString(" (edited)")
+		}
+
+		ref := "#" + message.ShortID()
+		dg.Dot.X = fixed.I(w-contentLeft) - dg.MeasureString(ref)
+		dg.Dot.Y = fixed.I(y)
+		dg.DrawString(ref)
 
 		y -= lineHeight * 5 / 4
 
-		if y < 0 {
+		if y < band+strip {
 			break
 		}
+		top = i
+	}
+
+	if strip > 0 {
+		// Draw the latest pin below the topic band.
+		p := pins[len(pins)-1]
+		max := fixed.I(w - contentLeft*2)
+		text, _, _ := strings.Cut(p.Text, "\n")
+		draw.Draw(img, image.Rect(0, band, w, band+strip), t.row, image.Pt(0, 0), draw.Src)
+		draw.Draw(img, image.Rect(0, band+strip-2*s, w, band+strip), t.shade, image.Pt(0, 0), draw.Src)
+		if v.collapsed {
+			dg.Dot = fixed.P(contentLeft, band+margin+lineHeight-5*s)
+			DrawStringOmitEmojis(dg, truncateText(dg, fmt.Sprintf("Pinned (%d) %s: %s", len(pins), p.From, text), max))
+		} else {
+			head := fmt.Sprintf("Pinned #%s from %s", p.ShortID(), p.From)
+			if len(pins) > 1 {
+				head += fmt.Sprintf(", %d more", len(pins)-1)
+			}
+			dg.Dot = fixed.P(contentLeft, band+margin+lineHeight-5*s)
+			DrawStringOmitEmojis(dg, truncateText(dg, head, max))
+			d.Dot = fixed.P(contentLeft, band+margin+lineHeight*2-5*s)
+			DrawStringOmitEmojis(d, truncateText(d, text, max))
+		}
+	}
+
+	if band > 0 {
+		// Draw topic band.
+		draw.Draw(img, image.Rect(0, 0, w, band), t.bar, image.Pt(0, 0), draw.Src)
+		draw.Draw(img, image.Rect(0, band-2*s, w, band), t.bar2, image.Pt(0, 0), draw.Src)
+		max := fixed.I(w - contentLeft*2)
+		d.Dot = fixed.P(contentLeft, margin+lineHeight-5*s)
+		DrawStringOmitEmojis(d, truncateText(d, topic, max))
+		if description != "" {
+			dg.Dot = fixed.P(contentLeft, margin+lineHeight*2-5*s)
+			DrawStringOmitEmojis(dg, truncateText(dg, description, max))
+		}
+	}
+
+	if v.history {
+		// Draw history bar.
+		margin := margin * 3 / 2
+		draw.Draw(img, image.Rect(0, h-barHeight, w, h), t.row, image.Pt(0, 0), draw.Src)
+		d.Dot.Y = fixed.I(h - (barHeight-16*s)/2 - 3*s)
+		d.Dot.X = fixed.I(margin)
+		if top < len(data) {
+			d.DrawString(inZone(data[top].UnixTime, v.loc).Format("2006-01-02 15:04"))
+			msg := inZone(data[len(data)-1].UnixTime, v.loc).Format("2006-01-02 15:04")
+			d.Dot.X = fixed.I(w-contentLeft) - d.MeasureString(msg)
+			d.DrawString(msg)
+		} else {
+			d.DrawString("No more history")
+		}
+		draw.Draw(img, image.Rect(0, h-2*s, w, h), t.rule, image.Pt(0, 0), draw.Src)
+		return img, top
 	}
 
 	{
 		// Draw bottom bar.
 		margin := margin * 3 / 2
-		draw.Draw(img, image.Rect(0, h-barHeight, w, h), wheat, image.Pt(0, 0), draw.Src)
-		d.Dot.Y = fixed.I(h - (barHeight-16)/2 - 3)
+		draw.Draw(img, image.Rect(0, h-barHeight, w, h), t.bar, image.Pt(0, 0), draw.Src)
+		d.Dot.Y = fixed.I(h - (barHeight-16*s)/2 - 3*s)
 
 		n := strconv.Itoa(ch.Len())
-		nx := margin + 16 + margin + d.MeasureString(n).Round() + margin
-		draw.Draw(img, image.Rect(0, h-barHeight, nx, h), gray[0], image.Pt(0, 0), draw.Src)
-		draw.Draw(img, image.Rect(margin, h-barHeight+(barHeight-16)/2, w, h), userIcon, image.Pt(0, 0), draw.Over)
-		d.Dot.X = fixed.I(margin + 16 + margin)
+		nx := margin + 16*s + margin + d.MeasureString(n).Round() + margin
+		draw.Draw(img, image.Rect(0, h-barHeight, nx, h), t.shade, image.Pt(0, 0), draw.Src)
+		iy := h - barHeight + (barHeight-16*s)/2
+		drawMaskScaled(img, image.Rect(margin, iy, margin+16*s, iy+16*s), t.text, userIcon, userIcon.Bounds())
+		d.Dot.X = fixed.I(margin + 16*s + margin)
 		d.DrawString(n)
 
-		ts := time.Now().Format("15:04")
+		ts := now.Format("15:04")
 		d.Dot.X = fixed.I(nx + margin*2)
 		d.DrawString(ts)
 
 		traffic := fmt.Sprintf("%dms %d:%.2fM",
-			ch.lastElapsed, len(ch.lastImgData[si].data)/1024, float64(ch.traffic)/1024/1024*4)
+			ch.lastElapsed, lastSize/1024, float64(ch.traffic)/1024/1024*4)
 		tw := d.MeasureString(traffic)
 		d.Dot.X = fixed.I(w-contentLeft) - tw
 		d.DrawString(traffic)
 
-		draw.Draw(img, image.Rect(0, h-2, nx, h), gray[2], image.Pt(0, 0), draw.Src)
-		draw.Draw(img, image.Rect(nx, h-2, w, h), wheat2, image.Pt(0, 0), draw.Src)
+		draw.Draw(img, image.Rect(0, h-2*s, nx, h), t.rule, image.Pt(0, 0), draw.Src)
+		draw.Draw(img, image.Rect(nx, h-2*s, w, h), t.bar2, image.Pt(0, 0), draw.Src)
 	}
 
 	ch.mu.Lock()
 	ch.links = links
 	ch.mu.Unlock()
-	return img
+	return img, top
 }
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/coyove/bbolt"
+	"github.com/sirupsen/logrus"
+)
+
+// ChannelInfo is stored in the "channel" bucket, after the 8 bytes active time.
+// It uses the same tagged layout as optional message fields.
+type ChannelInfo struct {
+	Owner       string
+	PassHash    []byte
+	Operators   []string
+	SlowMode    int64 // Seconds between two messages from the same IP
+	Topic       string
+	Description string
+	Members     []string // Participants of direct messages
+}
+
+const (
+	infoOwner    = 1
+	infoPassHash = 2
+	infoOperator = 3 // Repeated
+	infoSlowMode = 4
+	infoTopic    = 5
+	infoDesc     = 6
+	infoMember   = 7 // Repeated
+)
+
+// Cooldown returns the minimal interval between two messages.
+func (info ChannelInfo) Cooldown() time.Duration {
+	if info.SlowMode > 0 {
+		return time.Duration(info.SlowMode) * time.Second
+	}
+	return time.Second
+}
+
+func (info ChannelInfo) Marshal() (out []byte) {
+	appendTag := func(tag uint64, payload []byte) {
+		out = binary.AppendUvarint(out, tag)
+		out = appendString(out, string(payload))
+	}
+	if info.Owner != "" {
+		appendTag(infoOwner, []byte(info.Owner))
+	}
+	if len(info.PassHash) > 0 {
+		appendTag(infoPassHash, info.PassHash)
+	}
+	for _, op := range info.Operators {
+		appendTag(infoOperator, []byte(op))
+	}
+	if info.SlowMode > 0 {
+		appendTag(infoSlowMode, binary.AppendUvarint(nil, uint64(info.SlowMode)))
+	}
+	if info.Topic != "" {
+		appendTag(infoTopic, []byte(info.Topic))
+	}
+	if info.Description != "" {
+		appendTag(infoDesc, []byte(info.Description))
+	}
+	for _, m := range info.Members {
+		appendTag(infoMember, []byte(m))
+	}
+	return
+}
+
+func (info *ChannelInfo) Unmarshal(p []byte) error {
+	*info = ChannelInfo{}
+	r := reader{p: p}
+	for r.err == nil && len(r.p) > 0 {
+		tag := r.uvarint()
+		payload := r.bytes()
+		switch tag {
+		case infoOwner:
+			info.Owner = string(payload)
+		case infoPassHash:
+			info.PassHash = append([]byte{}, payload...)
+		case infoOperator:
+			info.Operators = append(info.Operators, string(payload))
+		case infoSlowMode:
+			v := reader{p: payload}
+			info.SlowMode = int64(v.uvarint())
+		case infoTopic:
+			info.Topic = string(payload)
+		case infoDesc:
+			info.Description = string(payload)
+		case infoMember:
+			info.Members = append(info.Members, string(payload))
+		}
+	}
+	return r.err
+}
+
+// getChannelInfo returns the info of channel name, ok is false if the channel
+// has never been created.
+func getChannelInfo(name string) (info ChannelInfo, ok bool) {
+	tx, err := world.store.Begin(false)
+	if err != nil {
+		logrus.Errorf("get channel info: %v", err)
+		return info, false
+	}
+	defer tx.Rollback()
+	if bk := tx.Bucket([]byte("channel")); bk != nil {
+		if v := bk.Get([]byte(name)); len(v) >= 8 {
+			if err := info.Unmarshal(v[8:]); err != nil {
+				logrus.Errorf("channel %s info: %v", name, err)
+			}
+			return info, true
+		}
+	}
+	return info, false
+}
+
+// updateChannelInfo calls f with the current info of channel name and stores
+// the result, the channel is created if needed.
+func updateChannelInfo(name string, f func(info *ChannelInfo) error) error {
+	tx, err := world.store.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	info := ChannelInfo{}
+	if bk := tx.Bucket([]byte("channel")); bk != nil {
+		if v := bk.Get([]byte(name)); len(v) >= 8 {
+			info.Unmarshal(v[8:])
+		}
+	}
+	if err := f(&info); err != nil {
+		return err
+	}
+	putChannel(tx, name, 0, &info)
+	return tx.Commit()
+}
+
+// putChannel updates the active time and info of channel name, zero active
+// and nil info keep the stored ones.
+func putChannel(tx *bbolt.Tx, name string, active int64, info *ChannelInfo) {
+	bk, _ := tx.CreateBucketIfNotExists([]byte("channel"))
+	bkSort, _ := tx.CreateBucketIfNotExists([]byte("channelsort"))
+
+	namebuf := []byte(name)
+	old := bk.Get(namebuf)
+	if len(old) >= 8 {
+		bkSort.Delete(append(old[:8:8], namebuf...))
+		if active == 0 {
+			active = int64(binary.BigEndian.Uint64(old))
+		}
+	}
+	if active == 0 {
+		active = time.Now().Unix()
+	}
+
+	value := binary.BigEndian.AppendUint64(nil, uint64(active))
+	if info != nil {
+		value = append(value, info.Marshal()...)
+	} else if len(old) > 8 {
+		value = append(value, old[8:]...)
+	}
+	bkSort.Put(append(value[:8:8], namebuf...), nil)
+	if created, _ := bk.TestPut(namebuf, value); created {
+		bk.NextSequence()
+	}
+}
+
+// createChannel creates channel name owned by owner if it doesn't exist yet,
+// an empty owner leaves the channel to admins.
+func createChannel(name, owner string) error {
+	if isDM(name) {
+		return errDMChannel
+	}
+	tx, err := world.store.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if bk := tx.Bucket([]byte("channel")); bk != nil && len(bk.Get([]byte(name))) > 0 {
+		return nil
+	}
+	putChannel(tx, name, 0, &ChannelInfo{Owner: owner})
+	return tx.Commit()
+}
@@ -1,9 +1,6 @@
 package main
 
 import (
-	"crypto/hmac"
-	"crypto/sha1"
-	"encoding/hex"
 	"flag"
 	"fmt"
 	"io"
@@ -15,12 +12,13 @@ import (
 	"sync"
 )
 
-var u, ch, admin string
+var u, ch, admin, token string
 
 func main() {
 	flag.StringVar(&u, "url", "", "")
 	flag.StringVar(&ch, "ch", "", "")
-	flag.StringVar(&admin, "admin", "", "")
+	flag.StringVar(&admin, "admin", "", "admin session token from the admin cookie")
+	flag.StringVar(&token, "token", "", "bot API token, messages are posted through the API if set")
 	flag.Parse()
 
 	if u == "" || ch == "" {
@@ -41,6 +39,23 @@ func main() {
 func send(wg *sync.WaitGroup) {
 	defer wg.Done()
 
+	msg := ""
+	for i, n := 0, rand.Intn(30)+30; i < n; i++ {
+		msg += string(rune(rand.Intn(65536)))
+	}
+
+	if token != "" {
+		req, _ := http.NewRequest("POST", u+"/~api/"+ch+"/send", strings.NewReader(url.Values{"msg": {msg}}.Encode()))
+		req.Header.Add("Authorization", "Bearer "+token)
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		return
+	}
+
 	req, _ := http.NewRequest("GET", u+"/~send/"+ch, nil)
 	req.Header.Add("User-Agent", "a Chrome/100.0.0.0")
 	resp, _ := http.DefaultClient.Do(req)
@@ -49,11 +64,6 @@ func send(wg *sync.WaitGroup) {
 	tok := regexp.MustCompile(`name=token value=(.+?)>`).FindSubmatch(body)[1]
 	// fmt.Println(string(tok))
 
-	msg := ""
-	for i, n := 0, rand.Intn(30)+30; i < n; i++ {
-		msg += string(rune(rand.Intn(65536)))
-	}
-
 	data := url.Values{}
 	data.Set("channel", ch)
 	data.Set("token", string(tok))
@@ -62,14 +72,8 @@ func send(wg *sync.WaitGroup) {
 	req, _ = http.NewRequest("POST", u+"/~send/"+ch, strings.NewReader(data.Encode()))
 	req.Header.Add("User-Agent", "a Chrome/100.0.0.0")
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Add("Cookie", "admin="+hmacHex(admin))
+	req.Header.Add("Cookie", "admin="+admin)
 	resp, _ = http.DefaultClient.Do(req)
 	body, _ = io.ReadAll(resp.Body)
 	resp.Body.Close()
 }
-
-func hmacHex(v string) string {
-	h := hmac.New(sha1.New, []byte(admin))
-	h.Write([]byte(v))
-	return hex.EncodeToString(h.Sum(nil))
-}
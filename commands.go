@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// command handles messages starting with "/name". run returns the text shown
+// in the send box, which is an error unless notice is true.
+type command struct {
+	usage string
+	mod   bool // Moderators only
+	run   func(c *Ctx, ch *Channel, info ChannelInfo, args string) (msg string, notice bool)
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"me":    {usage: "/me action", run: cmdMe},
+		"nick":  {usage: "/nick nickname", run: cmdNick},
+		"topic": {usage: "/topic [text]", run: cmdTopic},
+		"roll":  {usage: "/roll [NdM]", run: cmdRoll},
+		"kick":  {usage: "/kick nickname", mod: true, run: cmdKick},
+		"pin":   {usage: "/pin #ref", mod: true, run: cmdPin},
+		"unpin": {usage: "/unpin #ref", mod: true, run: cmdUnpin},
+		"help":  {usage: "/help [command]", run: cmdHelp},
+	}
+}
+
+// parseCommand splits "/name args" into its parts, "//text" escapes the slash.
+func parseCommand(msg string) (name, args string, ok bool) {
+	if !strings.HasPrefix(msg, "/") || strings.HasPrefix(msg, "//") {
+		return "", "", false
+	}
+	name, args, _ = strings.Cut(msg[1:], " ")
+	return strings.ToLower(name), strings.TrimSpace(args), true
+}
+
+func (c *Ctx) runCommand(ch *Channel, info ChannelInfo, name, args string) (string, bool) {
+	cmd, ok := commands[name]
+	if !ok {
+		return fmt.Sprintf("Unknown command /%s, try /help", name), false
+	}
+	if cmd.mod && !c.isModerator(ch.Name, info) {
+		return "Only moderators can use /" + name, false
+	}
+	return cmd.run(c, ch, info, args)
+}
+
+func (ch *Channel) system(from, text string) string {
+	if err := ch.Append(Message{From: from, Type: MessageSystem, Text: text}); err != nil {
+		logrus.Errorf("append message: %v", err)
+		return "Internal error"
+	}
+	ch.Refresh(-1)
+	return ""
+}
+
+func cmdMe(c *Ctx, ch *Channel, info ChannelInfo, args string) (string, bool) {
+	if args == "" {
+		return "Usage: " + commands["me"].usage, false
+	}
+	return ch.system(c.Uid, args), false
+}
+
+func cmdNick(c *Ctx, ch *Channel, info ChannelInfo, args string) (string, bool) {
+	old, want := c.Uid, sanitizeStrict(args, 20)
+	switch {
+	case want == "":
+		return "Usage: " + commands["nick"].usage, false
+	case want == old:
+		return "Nickname unchanged", false
+	case !c.isAdmin() && reservedName(want):
+		return "Nickname not available", false
+	}
+
+	c.Uid = want
+	c.SetUidCookie()
+	if c.Uid != want { // Registered by others or used by a bot
+		c.Uid = old
+		c.SetUidCookie()
+		return "Nickname not available", false
+	}
+	if !ch.rename(old, want, c.IP) {
+		c.Uid = old
+		c.SetUidCookie()
+		return fmt.Sprintf("'%s' already exists in this channel", want), false
+	}
+	return ch.system(old, "is now known as "+want), false
+}
+
+func cmdTopic(c *Ctx, ch *Channel, info ChannelInfo, args string) (string, bool) {
+	if args == "" {
+		if info.Topic == "" {
+			return "No topic", true
+		}
+		return "Topic: " + info.Topic, true
+	}
+	if !c.isOwner(info) {
+		return "Only the owner can change the topic", false
+	}
+	args = sanitizeLine(args, maxTopic)
+	if err := setTopic(ch.Name, args, info.Description); err != nil {
+		logrus.Errorf("[Channel %s] topic: %v", ch.Name, err)
+		return "Internal error", false
+	}
+	return ch.system(c.Uid, "changed the topic to: "+args), false
+}
+
+func cmdRoll(c *Ctx, ch *Channel, info ChannelInfo, args string) (string, bool) {
+	n, m := 1, 6
+	if args != "" {
+		a, b, ok := strings.Cut(strings.ToLower(args), "d")
+		n, _ = strconv.Atoi(a)
+		m, _ = strconv.Atoi(b)
+		if a == "" {
+			n = 1
+		}
+		if !ok || n < 1 || n > 20 || m < 2 || m > 1000 {
+			return "Usage: " + commands["roll"].usage + ", N up to 20, M up to 1000", false
+		}
+	}
+
+	out := bytes.Buffer{}
+	sum := 0
+	for i := 0; i < n; i++ {
+		v := rand.Intn(m) + 1
+		sum += v
+		if i > 0 {
+			out.WriteString(" + ")
+		}
+		out.WriteString(strconv.Itoa(v))
+	}
+	if n > 1 {
+		fmt.Fprintf(&out, " = %d", sum)
+	}
+	return ch.system(c.Uid, fmt.Sprintf("rolled %dd%d: %s", n, m, out.String())), false
+}
+
+func cmdKick(c *Ctx, ch *Channel, info ChannelInfo, args string) (string, bool) {
+	uid := sanitizeStrict(args, 20)
+	if uid != "" && uid == info.Owner {
+		return "The owner can't be kicked", false
+	}
+	if !ch.Kick(uid, "You have been kicked") {
+		return "User not online", false
+	}
+	c.audit("#%s kick %s", ch.Name, uid)
+	return ch.system(c.Uid, "kicked "+uid), false
+}
+
+func cmdHelp(c *Ctx, ch *Channel, info ChannelInfo, args string) (string, bool) {
+	if cmd, ok := commands[strings.TrimPrefix(args, "/")]; ok {
+		return cmd.usage, true
+	}
+	var names []string
+	for name, cmd := range commands {
+		if !cmd.mod || c.isModerator(ch.Name, info) {
+			names = append(names, "/"+name)
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, " ") + ", //text to send /text", true
+}
+
+// rename moves the online windows of old to nickname to, it fails if to is
+// used by another IP in ch.
+func (ch *Channel) rename(old, to string, ip []byte) bool {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if arr := ch.onlines[to]; len(arr) > 0 && !bytes.Equal(arr[len(arr)-1].ip, ip) {
+		return false
+	}
+	if arr := ch.onlines[old]; len(arr) > 0 {
+		for _, state := range arr {
+			state.uid = to
+		}
+		ch.onlines[to] = append(ch.onlines[to], arr...)
+		delete(ch.onlines, old)
+	}
+	return true
+}
@@ -7,6 +7,7 @@ import (
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"math/rand"
 	"net"
@@ -55,11 +56,13 @@ type Ctx struct {
 	IP    net.IP
 	Query url.Values
 	Uid   string
+	User  string // Registered nickname the client has logged in as
+	Admin *adminSession
 }
 
 func handle(p string, f func(Ctx)) {
 	http.HandleFunc(p, func(w http.ResponseWriter, r *http.Request) {
-		for ua := r.UserAgent(); ; {
+		for ua := r.UserAgent(); !strings.HasPrefix(r.URL.Path, "/~api/"); {
 			if idx := strings.Index(ua, "Chrome/"); idx > 0 {
 				major, _, _ := strings.Cut(ua[idx+7:], ".")
 				if i, _ := strconv.Atoi(major); i >= 32 {
@@ -96,6 +99,14 @@ func handle(p string, f func(Ctx)) {
 			Query:          r.URL.Query(),
 		}
 
+		if ck, _ := r.Cookie("auth"); ck != nil {
+			c.User, _ = parseAuthToken(ck.Value)
+		}
+
+		if ck, _ := r.Cookie("admin"); ck != nil {
+			c.Admin, _ = loadAdminSession(ck.Value)
+		}
+
 		ck, _ := r.Cookie("uid2")
 		if ck != nil {
 			v, err := base64.URLEncoding.DecodeString(ck.Value)
@@ -118,6 +129,11 @@ func (c *Ctx) SetUidCookie() {
 		c.Uid = ipuid(c.IP, c.UserAgent())
 	} else {
 		c.Uid = sanitizeStrict(c.Uid, 20)
+		if _, registered := getUser(c.Uid); registered && c.Uid != c.User {
+			c.Uid = ipuid(c.IP, c.UserAgent())
+		} else if _, bot := getBot(c.Uid); bot {
+			c.Uid = ipuid(c.IP, c.UserAgent())
+		}
 	}
 	c.ResponseWriter.Header().Del("Set-Cookie")
 	http.SetCookie(c.ResponseWriter, &http.Cookie{
@@ -141,6 +157,12 @@ func (c Ctx) Template(name string, arg any) {
 	httpTemplates.ExecuteTemplate(c.ResponseWriter, name, arg)
 }
 
+func (c Ctx) JSON(code int, v any) {
+	c.ResponseWriter.Header().Set("Content-Type", "application/json; charset=utf-8")
+	c.WriteHeader(code)
+	json.NewEncoder(c.ResponseWriter).Encode(v)
+}
+
 func (c Ctx) Write(p []byte) (int, error) {
 	return c.ResponseWriter.Write(p)
 }
@@ -163,11 +185,9 @@ func ipuid(ip net.IP, ua string) string {
 	return *(*string)(unsafe.Pointer(&res))
 }
 
-func (c Ctx) isAdmin() bool {
-	if ck, _ := c.Cookie("admin"); ck == nil || ck.Value != onlineKeyhash {
-		return false
-	}
-	return true
+// Verified tells whether c is using the registered nickname it has logged in as.
+func (c Ctx) Verified() bool {
+	return c.User != "" && c.Uid == c.User
 }
 
 func hmacHex(v string) string {
@@ -178,23 +198,28 @@ func hmacHex(v string) string {
 
 var cdMap sync.Map
 
-func (c Ctx) CheckIP() (ok bool) {
+type cdKey struct {
+	ip      [16]byte
+	channel string
+}
+
+func (c Ctx) CheckIP(channel string) (ok bool) {
 	if c.isAdmin() {
 		return true
 	}
-	var ip [16]byte
-	copy(ip[:], c.IP)
-	_, exist := cdMap.Load(ip)
+	k := cdKey{channel: channel}
+	copy(k.ip[:], c.IP)
+	_, exist := cdMap.Load(k)
 	return !exist
 }
 
-func (c Ctx) AddIP() {
-	var ip [16]byte
-	copy(ip[:], c.IP)
-	old, _ := cdMap.Swap(ip, 1)
+func (c Ctx) AddIP(channel string, d time.Duration) {
+	k := cdKey{channel: channel}
+	copy(k.ip[:], c.IP)
+	old, _ := cdMap.Swap(k, 1)
 	if old != 1 {
-		time.AfterFunc(time.Second*1, func() {
-			cdMap.Delete(ip)
+		time.AfterFunc(d, func() {
+			cdMap.Delete(k)
 		})
 	}
 }
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Direct message channels are named by dmPrefix and the hash of both
+// participants, which are stored as Members of the channel. Only logged in
+// users can have direct messages, so a nickname can't be taken over.
+const dmPrefix = "dm--"
+
+var errDMChannel = errors.New("direct message channels can't be created directly")
+
+func isDM(name string) bool {
+	return strings.HasPrefix(name, dmPrefix)
+}
+
+func dmChannelName(a, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+	h := sha1.Sum([]byte(a + "\x00" + b))
+	return dmPrefix + hex.EncodeToString(h[:8])
+}
+
+func (c Ctx) isMember(info ChannelInfo) bool {
+	if !c.Verified() {
+		return false
+	}
+	for _, m := range info.Members {
+		if m == c.Uid {
+			return true
+		}
+	}
+	return false
+}
+
+// dmPeer returns the other participant of a direct message channel.
+func dmPeer(info ChannelInfo, me string) string {
+	for _, m := range info.Members {
+		if m != me {
+			return m
+		}
+	}
+	return me
+}
+
+// openDM creates the direct message channel between users a and b if needed.
+func openDM(a, b string) (string, error) {
+	name := dmChannelName(a, b)
+	tx, err := world.store.Begin(true)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	if bk := tx.Bucket([]byte("channel")); bk == nil || len(bk.Get([]byte(name))) == 0 {
+		members := []string{a, b}
+		sort.Strings(members)
+		putChannel(tx, name, 0, &ChannelInfo{
+			Members: members,
+			Topic:   "Direct messages between " + members[0] + " and " + members[1],
+		})
+	}
+	for _, uid := range []string{a, b} {
+		bk, _ := tx.CreateBucketIfNotExists([]byte("dm-" + uid))
+		if len(bk.Get([]byte(name))) == 0 {
+			bk.Put([]byte(name), make([]byte, 8))
+		}
+	}
+	return name, tx.Commit()
+}
+
+// markDMRead records the latest message of channel name as read by uid.
+func markDMRead(uid, name string) {
+	tx, err := world.store.Begin(true)
+	if err != nil {
+		logrus.Errorf("mark dm read: %v", err)
+		return
+	}
+	defer tx.Rollback()
+	bk := tx.Bucket([]byte("dm-" + uid))
+	if bk == nil || len(bk.Get([]byte(name))) == 0 {
+		return
+	}
+	if msgs := tx.Bucket([]byte("channel-" + name)); msgs != nil {
+		if k, _ := msgs.Cursor().Last(); len(k) == 8 {
+			bk.Put([]byte(name), append([]byte{}, k...))
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		logrus.Errorf("mark dm read: %v", err)
+	}
+}
+
+// listDMs returns the direct message channels of uid with unread counts,
+// the most recently active first.
+func listDMs(uid string) (res []map[string]any) {
+	tx, err := world.store.Begin(false)
+	if err != nil {
+		return nil
+	}
+	defer tx.Rollback()
+	bk := tx.Bucket([]byte("dm-" + uid))
+	channels := tx.Bucket([]byte("channel"))
+	if bk == nil || channels == nil {
+		return nil
+	}
+	bk.ForEach(func(k, v []byte) error {
+		info := ChannelInfo{}
+		chv := channels.Get(k)
+		if len(chv) < 8 || info.Unmarshal(chv[8:]) != nil || len(v) != 8 {
+			return nil
+		}
+		var unread int
+		if msgs := tx.Bucket(append([]byte("channel-"), k...)); msgs != nil {
+			c := msgs.Cursor()
+			for mk, mv := c.Seek(binary.BigEndian.AppendUint64(nil, binary.BigEndian.Uint64(v)+1)); len(mk) > 0 && unread < 99; mk, mv = c.Next() {
+				m := Message{}
+				if m.Unmarshal(mv) == nil && m.Type == MessageText && m.From != uid {
+					unread++
+				}
+			}
+		}
+		res = append(res, map[string]any{
+			"name":   string(k),
+			"peer":   dmPeer(info, uid),
+			"unread": unread,
+			"active": int64(binary.BigEndian.Uint64(chv[:8])),
+		})
+		return nil
+	})
+	sort.Slice(res, func(i, j int) bool { return res[i]["active"].(int64) > res[j]["active"].(int64) })
+	return res
+}
+
+func handleDM(c Ctx) {
+	peer := sanitizeStrict(strings.TrimPrefix(c.URL.Path, "/~dm/"), 20)
+	if peer == "" {
+		peer = sanitizeStrict(c.Query.Get("to"), 20)
+	}
+	if !c.Verified() {
+		c.Redirect(302, "/~login")
+		return
+	}
+	if _, ok := getUser(peer); !ok || peer == c.Uid {
+		c.WriteHeader(404)
+		c.Printf("User %s is not registered", peer)
+		return
+	}
+
+	name, err := openDM(c.Uid, peer)
+	if err != nil {
+		logrus.Errorf("open dm: %v", err)
+		c.WriteHeader(500)
+		return
+	}
+	c.Redirect(302, "/"+name+"?w="+strconv.Itoa(c.width()))
+}
@@ -6,7 +6,6 @@ import (
 	"encoding/base64"
 	"encoding/binary"
 	"image"
-	"image/color"
 	"image/draw"
 	"image/jpeg"
 	"image/png"
@@ -15,6 +14,7 @@ import (
 	"sync"
 	"unicode/utf8"
 
+	xdraw "golang.org/x/image/draw"
 	"golang.org/x/image/font"
 	"golang.org/x/image/font/opentype"
 	"golang.org/x/image/font/sfnt"
@@ -46,16 +46,22 @@ var (
 
 	drawFont *sfnt.Font
 
-	facePool = &sync.Pool{
-		New: func() any {
-			f0, _ := opentype.NewFace(drawFont, &opentype.FaceOptions{
-				Size:    16,
-				DPI:     72,
-				Hinting: font.HintingFull,
-			})
-			return f0
-		},
-	}
+	facePools = func() (pools [maxScale + 1]*sync.Pool) {
+		for s := 1; s <= maxScale; s++ {
+			s := s
+			pools[s] = &sync.Pool{
+				New: func() any {
+					f0, _ := opentype.NewFace(drawFont, &opentype.FaceOptions{
+						Size:    float64(16 * s),
+						DPI:     72,
+						Hinting: font.HintingFull,
+					})
+					return &scaledFace{Face: f0, scale: s}
+				},
+			}
+		}
+		return
+	}()
 
 	//go:embed embedded/4-letter.txt
 	wordDictData string
@@ -108,17 +114,6 @@ var (
 		}
 		return m
 	}()
-
-	gray = [...]*image.Uniform{
-		image.NewUniform(color.RGBA{200, 200, 200, 255}),
-		image.NewUniform(color.RGBA{245, 245, 245, 255}),
-		image.NewUniform(color.RGBA{180, 180, 180, 255}),
-		image.NewUniform(color.RGBA{120, 120, 120, 255}),
-	}
-	blue   = image.NewUniform(color.RGBA{0, 0, 255, 255})
-	blue2  = image.NewUniform(color.RGBA{0, 0, 255, 120})
-	wheat  = image.NewUniform(color.RGBA{0xff, 0xec, 0xb3, 255})
-	wheat2 = image.NewUniform(color.RGBA{0xee, 0xdb, 0xa2, 255})
 )
 
 type emojiSuffix struct {
@@ -126,8 +121,50 @@ type emojiSuffix struct {
 	x, y int
 }
 
+// scaledFace is a face of size 16*scale, sizes of everything drawn along with
+// it are multiplied by scale too.
+type scaledFace struct {
+	font.Face
+	scale int
+}
+
+func getFace(scale int) *scaledFace {
+	return facePools[scale].Get().(*scaledFace)
+}
+
+func putFace(f *scaledFace) {
+	facePools[f.scale].Put(f)
+}
+
+func faceScale(f font.Face) int {
+	if sf, ok := f.(*scaledFace); ok {
+		return sf.scale
+	}
+	return 1
+}
+
+// drawScaled draws sr of src over r of dst, resizing it if needed.
+func drawScaled(dst draw.Image, r image.Rectangle, src image.Image, sr image.Rectangle) {
+	if r.Size() == sr.Size() {
+		draw.Draw(dst, r, src, sr.Min, draw.Over)
+		return
+	}
+	xdraw.ApproxBiLinear.Scale(dst, r, src, sr, draw.Over, nil)
+}
+
+// drawMaskScaled draws src through mr of mask over r of dst, resizing the mask
+// if needed.
+func drawMaskScaled(dst draw.Image, r image.Rectangle, src image.Image, mask image.Image, mr image.Rectangle) {
+	if r.Size() == mr.Size() {
+		draw.DrawMask(dst, r, src, image.Point{}, mask, mr.Min, draw.Over)
+		return
+	}
+	xdraw.NearestNeighbor.Scale(dst, r, src, mr, draw.Over, &xdraw.Options{SrcMask: mask})
+}
+
 func DrawStringOmitEmojis(d *font.Drawer, s string) {
 	prevC := rune(-1)
+	scale := faceScale(d.Face)
 
 	for len(s) > 0 {
 		c, cw := utf8.DecodeRuneInString(s)
@@ -142,19 +179,17 @@ func DrawStringOmitEmojis(d *font.Drawer, s string) {
 
 		if cand, ok := probeEmoji(c, s); ok {
 			s = s[len(cand.text):]
-			d.Dot.X += fixed.I(emojiAdvance)
+			d.Dot.X += fixed.I(emojiAdvance * scale)
 			prevC = -1
 			continue
 		}
 
 		if _, _, ok := d.Face.GlyphBounds(c); !ok && c < 0x10000 {
-			xx, yy := d.Dot.X.Round()+1, d.Dot.Y.Round()-14
-			for i := 0; i < 1; i++ {
-				draw.DrawMask(d.Dst, image.Rect(xx+i, yy, xx+i+16, yy+16),
-					d.Src, image.Point{},
-					unifont, image.Point{int(c) % 256 * 16, int(c) / 256 * 16}, draw.Over)
-			}
-			d.Dot.X += fixed.I(18)
+			xx, yy := d.Dot.X.Round()+scale, d.Dot.Y.Round()-14*scale
+			mx, my := int(c)%256*16, int(c)/256*16
+			drawMaskScaled(d.Dst, image.Rect(xx, yy, xx+16*scale, yy+16*scale),
+				d.Src, unifont, image.Rect(mx, my, mx+16, my+16))
+			d.Dot.X += fixed.I(18 * scale)
 			continue
 		}
 
@@ -167,6 +202,30 @@ func DrawStringOmitEmojis(d *font.Drawer, s string) {
 	}
 }
 
+// drawMentions draws s with d, nicknames in mentions written as @name are
+// drawn with du instead.
+func drawMentions(d, du *font.Drawer, s string, mentions []string) {
+	for len(mentions) > 0 {
+		i := strings.IndexByte(s, '@')
+		if i < 0 {
+			break
+		}
+		name, n := mentionAt(s[i:])
+		prev, _ := utf8.DecodeLastRuneInString(s[:i])
+		if (i > 0 && isNameRune(prev)) || !contains(mentions, name) {
+			DrawStringOmitEmojis(d, s[:i+1])
+			s = s[i+1:]
+			continue
+		}
+		DrawStringOmitEmojis(d, s[:i])
+		du.Dot = d.Dot
+		DrawStringOmitEmojis(du, s[i:i+n])
+		d.Dot = du.Dot
+		s = s[i+n:]
+	}
+	DrawStringOmitEmojis(d, s)
+}
+
 func noDrawRune(r rune) bool {
 	return r == '\r' || r == 0x200D || (0xFE00 <= r && r <= 0xFE0F)
 }
@@ -186,20 +245,21 @@ func probeEmoji(head rune, suffix string) (emojiSuffix, bool) {
 	return emojiSuffix{}, false
 }
 
-func makeErrorImage(w, h int, msg string) []byte {
+func makeErrorImage(v view, msg string) []byte {
+	w, h := v.width*v.scale, screenHeight*v.scale
 	img := image.NewRGBA(image.Rect(0, 0, w, h))
-	face := facePool.Get().(font.Face)
+	face := getFace(v.scale)
 
 	defer func() {
-		facePool.Put(face)
+		putFace(face)
 	}()
 
-	draw.Draw(img, img.Bounds(), image.White, image.Pt(0, 0), draw.Src)
-	d := &font.Drawer{Dst: img, Src: image.Black, Face: face}
+	draw.Draw(img, img.Bounds(), v.theme.bg, image.Pt(0, 0), draw.Src)
+	d := &font.Drawer{Dst: img, Src: v.theme.text, Face: face}
 	tw := d.MeasureString(msg).Round()
 
 	d.Dot.X = fixed.I((w - tw) / 2)
-	d.Dot.Y = fixed.I(h - 10)
+	d.Dot.Y = fixed.I(h - 10*v.scale)
 	d.DrawString(msg)
 
 	out := &bytes.Buffer{}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+
+	"github.com/coyove/bbolt"
+	"github.com/sirupsen/logrus"
+)
+
+// patchMessage applies the edit or delete op to its target stored in bk.
+func patchMessage(bk *bbolt.Bucket, op Message) (m Message, err error) {
+	key := binary.BigEndian.AppendUint64(nil, op.Target)
+	v := bk.Get(key)
+	if len(v) == 0 {
+		return m, fmt.Errorf("message %d not found", op.Target)
+	}
+	if err := m.Unmarshal(v); err != nil {
+		return m, err
+	}
+	if m.IsOp() || m.Flags&MessageDeleted != 0 {
+		return m, fmt.Errorf("message %d can't be modified", op.Target)
+	}
+
+	m.EditTime = op.UnixTime
+	switch op.Type {
+	case MessageEdit:
+		m.Text = op.Text
+		m.Mentions = parseMentions(op.Text)
+	case MessageDelete:
+		m.Text = ""
+		m.Mentions = nil
+		m.Flags |= MessageDeleted
+	}
+	return m, bk.Put(key, m.Marshal())
+}
+
+func (ch *Channel) replaceMessage(m Message) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	for i := range ch.data {
+		if ch.data[i].ID == m.ID {
+			// Copy on write, render may be reading the old slice.
+			data := append([]Message{}, ch.data...)
+			data[i] = m
+			ch.data = data
+			return
+		}
+	}
+}
+
+func findMessage(name string, id uint64) (m Message, ok bool) {
+	tx, err := world.store.Begin(false)
+	if err != nil {
+		logrus.Errorf("find message: %v", err)
+		return m, false
+	}
+	defer tx.Rollback()
+	if bk := tx.Bucket([]byte("channel-" + name)); bk != nil {
+		if v := bk.Get(binary.BigEndian.AppendUint64(nil, id)); len(v) > 0 {
+			return m, m.Unmarshal(v) == nil
+		}
+	}
+	return m, false
+}
+
+// isAuthor reports whether c sent m, messages sent by registered users can only
+// be changed after logging in.
+func (c Ctx) isAuthor(m Message) bool {
+	return m.From == c.Uid && (m.Flags&MessageVerified == 0 || c.Verified())
+}
+
+func handleEdit(c Ctx) {
+	name := sanitizeChannelName(c.URL.Path[7:])
+	if name == "" {
+		c.WriteHeader(404)
+		return
+	}
+	if !c.canAccess(name) {
+		c.Redirect(302, "/~unlock/"+name+"?w="+strconv.Itoa(c.width()))
+		return
+	}
+
+	ch, err := openChannel(name)
+	if err != nil {
+		logrus.Errorf("load channel: %v", err)
+		c.WriteHeader(500)
+		return
+	}
+
+	var msg string
+	if c.Method == "POST" {
+		id, _ := strconv.ParseUint(c.FormValue("id"), 10, 64)
+		m, ok := findMessage(name, id)
+
+		switch {
+		case validateToken(c, c.FormValue("token")) != 1:
+			msg = "Invalid session"
+		case !ok || m.IsOp() || m.Type == MessageSystem || m.Flags&MessageDeleted != 0:
+			msg = "Message not found"
+		case !c.isAuthor(m) && !c.isAdmin():
+			msg = "Not your message"
+		default:
+			op := Message{From: c.Uid, Type: MessageEdit, Target: id, Text: sanitizeMessage(c.FormValue("msg"))}
+			if c.FormValue("op") == "delete" {
+				op.Type, op.Text = MessageDelete, ""
+			} else if op.Text == "" {
+				msg = "Empty message"
+				break
+			}
+			if err := ch.Append(op); err != nil {
+				logrus.Errorf("edit message: %v", err)
+				msg = "Internal error"
+				break
+			}
+			if m.From != c.Uid {
+				c.audit("#%s %s message #%s of %s", name, c.FormValue("op"), m.ShortID(), m.From)
+			}
+			ch.Refresh(-1)
+			c.Redirect(302, c.URL.Path+"?"+c.URL.RawQuery)
+			return
+		}
+	}
+
+	ch.mu.Lock()
+	data := ch.data
+	ch.mu.Unlock()
+
+	var items []map[string]any
+	for i := len(data) - 1; i >= 0; i-- {
+		m := data[i]
+		switch {
+		case m.Type == MessageJoin, m.Type == MessageLeave, m.Type == MessageSystem, m.Flags&MessageDeleted != 0:
+		case c.isAuthor(m) || c.isAdmin():
+			items = append(items, map[string]any{
+				"id":    m.ID,
+				"from":  m.From,
+				"time":  inZone(m.UnixTime, c.timezone()).Format("01-02 15:04:05"),
+				"text":  m.Text,
+				"token": makeToken(c),
+			})
+		}
+	}
+
+	c.Template("edit.html", map[string]any{
+		"name":  name,
+		"width": c.width(),
+		"err":   msg,
+		"items": items,
+		"theme": c.theme(),
+	})
+}
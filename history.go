@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"strconv"
+	"time"
+
+	"github.com/coyove/bbolt"
+	"github.com/sirupsen/logrus"
+)
+
+// messageIDAt returns the smallest message ID that can be generated at unix.
+func messageIDAt(unix int64) uint64 {
+	return uint64(unix-16e8) << 31
+}
+
+// trimHistory enforces -history-n and -history-age on bucket bk. The bucket
+// sequence is used as the message counter.
+func (ch *Channel) trimHistory(bk *bbolt.Bucket) {
+	n, _ := bk.NextSequence()
+	c := bk.Cursor()
+	drop := func(v []byte) {
+		m := Message{}
+		if m.Unmarshal(v) == nil {
+			indexMessage(bk.Tx(), ch.Name, m, true)
+		}
+		c.Delete()
+		n--
+	}
+	if !ch.historySync {
+		// Buckets created by older versions count every put, correct it once.
+		n = 0
+		for k, _ := c.First(); len(k) > 0; k, _ = c.Next() {
+			n++
+		}
+		ch.historySync = true
+	}
+
+	if *historyN > 0 {
+		for k, v := c.First(); len(k) > 0 && n > uint64(*historyN); k, v = c.First() {
+			drop(v)
+		}
+	}
+	if *historyAge > 0 {
+		cutoff := messageIDAt(time.Now().Add(-*historyAge).Unix())
+		for k, v := c.First(); len(k) == 8 && binary.BigEndian.Uint64(k) < cutoff; k, v = c.First() {
+			drop(v)
+		}
+	}
+	bk.SetSequence(n)
+}
+
+// loadHistory returns at most n messages whose IDs are less than before, in
+// ascending order. Zero before means the latest ones.
+func loadHistory(name string, before uint64, n int) (res []Message, err error) {
+	tx, err := world.store.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	bk := tx.Bucket([]byte("channel-" + name))
+	if bk == nil {
+		return nil, nil
+	}
+
+	c := bk.Cursor()
+	k, v := c.Last()
+	if before > 0 {
+		if k, v = c.Seek(binary.BigEndian.AppendUint64(nil, before)); len(k) > 0 {
+			k, v = c.Prev()
+		} else {
+			k, v = c.Last()
+		}
+	}
+	for ; len(k) > 0 && len(res) < n; k, v = c.Prev() {
+		m := Message{}
+		if err := m.Unmarshal(v); err != nil {
+			return nil, err
+		}
+		if !m.IsOp() {
+			res = append(res, m)
+		}
+	}
+	for i, j := 0, len(res)-1; i < j; i, j = i+1, j-1 {
+		res[i], res[j] = res[j], res[i]
+	}
+	return res, nil
+}
+
+func handleHistory(c Ctx) {
+	name := sanitizeChannelName(c.URL.Path[10:])
+	if name == "" {
+		c.WriteHeader(404)
+		return
+	}
+	if !c.canAccess(name) {
+		c.Redirect(302, "/~unlock/"+name+"?w="+strconv.Itoa(c.width()))
+		return
+	}
+
+	before, _ := strconv.ParseUint(c.Query.Get("before"), 10, 64)
+	data, err := loadHistory(name, before, screenMessages)
+	if err != nil {
+		logrus.Errorf("load history: %v", err)
+		c.WriteHeader(500)
+		return
+	}
+
+	width, _ := strconv.Atoi(c.Query.Get("w"))
+	width = screenWidth(width)
+
+	ch, ok := findChannel(name)
+	if !ok {
+		ch = &Channel{Name: name}
+	}
+	img, top := ch.render(view{width: width, scale: 1, history: true, loc: c.timezone(), theme: c.theme()}, data)
+
+	out := encodeImage(img, *format, 50)
+
+	var older uint64
+	if top < len(data) && (top > 0 || len(data) == screenMessages) {
+		older = data[top].ID
+	}
+
+	c.Template("history.html", map[string]any{
+		"name":  name,
+		"width": width,
+		"img":   base64.StdEncoding.EncodeToString(out.data),
+		"mime":  out.mime,
+		"older": older,
+		"theme": c.theme(),
+	})
+}
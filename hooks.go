@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/coyove/bbolt"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	maxHooks        = 5
+	maxHookAttempts = 8
+	hookLogSize     = 100
+	hookBackoff     = time.Second * 10 // Doubled after each failed attempt
+	hookMaxBackoff  = time.Hour
+	maxHookQueue    = 100 // Pending deliveries per channel, newer ones are dropped
+)
+
+var errHookAddr = errors.New("webhook address not allowed")
+
+var hookClient = &http.Client{
+	Timeout: time.Second * 10,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: time.Second * 5,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, _ := net.SplitHostPort(address)
+				ip := net.ParseIP(host)
+				if ip == nil || (!*hookPrivate && (ip.IsLoopback() || ip.IsPrivate() ||
+					ip.IsUnspecified() || ip.IsLinkLocalUnicast() || !ip.IsGlobalUnicast())) {
+					return errHookAddr
+				}
+				return nil
+			},
+		}).DialContext,
+	},
+}
+
+// hookWorkers maps channels with pending deliveries to the wake channel of
+// their worker, so a slow endpoint only delays its own channel.
+var hookWorkers = struct {
+	sync.Mutex
+	m map[string]chan struct{}
+}{m: map[string]chan struct{}{}}
+
+// webhook is stored in the "hooks-<channel>" bucket keyed by its big endian ID.
+type webhook struct {
+	ID      uint64
+	URL     string
+	Secret  string
+	By      string
+	Created int64
+}
+
+func (h webhook) marshal() (out []byte) {
+	out = binary.AppendVarint(out, h.Created)
+	out = appendString(out, h.URL)
+	out = appendString(out, h.Secret)
+	out = appendString(out, h.By)
+	return
+}
+
+func (h *webhook) unmarshal(k, v []byte) error {
+	h.ID = binary.BigEndian.Uint64(k)
+	r := reader{p: v}
+	h.Created = r.varint()
+	h.URL = string(r.bytes())
+	h.Secret = string(r.bytes())
+	h.By = string(r.bytes())
+	return r.err
+}
+
+// hookJob is stored in the "hookqueue-<channel>" bucket keyed by the big endian
+// due time and a sequence number, so the worker can scan due jobs in order.
+type hookJob struct {
+	Channel  string
+	HookID   uint64
+	Event    string
+	Body     []byte
+	Attempts int64
+}
+
+func (j hookJob) marshal() (out []byte) {
+	out = appendString(out, j.Channel)
+	out = binary.AppendUvarint(out, j.HookID)
+	out = appendString(out, j.Event)
+	out = binary.AppendVarint(out, j.Attempts)
+	out = appendString(out, string(j.Body))
+	return
+}
+
+func (j *hookJob) unmarshal(v []byte) error {
+	r := reader{p: v}
+	j.Channel = string(r.bytes())
+	j.HookID = r.uvarint()
+	j.Event = string(r.bytes())
+	j.Attempts = r.varint()
+	j.Body = append([]byte{}, r.bytes()...)
+	return r.err
+}
+
+func putHookJob(bk *bbolt.Bucket, due time.Time, j hookJob) error {
+	seq, _ := bk.NextSequence()
+	k := binary.BigEndian.AppendUint64(nil, uint64(due.Unix()))
+	return bk.Put(binary.BigEndian.AppendUint64(k, seq), j.marshal())
+}
+
+func hookEvent(m Message) string {
+	switch m.Type {
+	case MessageJoin:
+		return "join"
+	case MessageLeave:
+		return "leave"
+	case MessageEdit:
+		return "edit"
+	case MessageDelete:
+		return "delete"
+	}
+	return "message"
+}
+
+func listHooks(name string) (res []webhook) {
+	tx, err := world.store.Begin(false)
+	if err != nil {
+		return nil
+	}
+	defer tx.Rollback()
+	if bk := tx.Bucket([]byte("hooks-" + name)); bk != nil {
+		bk.ForEach(func(k, v []byte) error {
+			h := webhook{}
+			if h.unmarshal(k, v) == nil {
+				res = append(res, h)
+			}
+			return nil
+		})
+	}
+	return res
+}
+
+// queueHooks enqueues a delivery of m for each webhook of channel name, or logs
+// it as dropped if the channel already has maxHookQueue pending.
+func queueHooks(name string, m Message) {
+	hooks := listHooks(name)
+	if len(hooks) == 0 {
+		return
+	}
+
+	body, _ := json.Marshal(map[string]any{
+		"event":   hookEvent(m),
+		"channel": name,
+		"message": m,
+	})
+	tx, err := world.store.Begin(true)
+	if err != nil {
+		logrus.Errorf("[Channel %s] queue hooks: %v", name, err)
+		return
+	}
+	defer tx.Rollback()
+	bk, _ := tx.CreateBucketIfNotExists([]byte("hookqueue-" + name))
+	n := bk.Stats().KeyN
+	for _, h := range hooks {
+		job := hookJob{Channel: name, HookID: h.ID, Event: hookEvent(m), Body: body}
+		if n >= maxHookQueue {
+			logHookDelivery(tx, job, h, "dropped, queue full", false)
+			continue
+		}
+		putHookJob(bk, time.Now(), job)
+		n++
+	}
+	if err := tx.Commit(); err != nil {
+		logrus.Errorf("[Channel %s] queue hooks: %v", name, err)
+		return
+	}
+	wakeHooks(name)
+}
+
+// startHooks starts workers for channels with deliveries left from last run.
+func startHooks() {
+	var names []string
+	tx, err := world.store.Begin(false)
+	if err != nil {
+		logrus.Errorf("hooks: %v", err)
+		return
+	}
+	tx.ForEach(func(k []byte, _ *bbolt.Bucket) error {
+		if name, ok := strings.CutPrefix(string(k), "hookqueue-"); ok {
+			names = append(names, name)
+		}
+		return nil
+	})
+	tx.Rollback()
+	for _, name := range names {
+		wakeHooks(name)
+	}
+}
+
+// wakeHooks wakes the worker of channel name, starting one if there is none.
+func wakeHooks(name string) {
+	hookWorkers.Lock()
+	defer hookWorkers.Unlock()
+	if wake, ok := hookWorkers.m[name]; ok {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+		return
+	}
+	wake := make(chan struct{}, 1)
+	hookWorkers.m[name] = wake
+	go runHooks(name, wake)
+}
+
+// runHooks delivers queued jobs of channel name until there are none, failed
+// jobs are retried with exponential backoff until maxHookAttempts.
+func runHooks(name string, wake chan struct{}) {
+	for {
+		for deliverDueHook(name) {
+		}
+		hookWorkers.Lock()
+		if !hasHookJobs(name) {
+			delete(hookWorkers.m, name)
+			hookWorkers.Unlock()
+			return
+		}
+		hookWorkers.Unlock()
+		select {
+		case <-wake:
+		case <-time.After(time.Second * 5):
+		}
+	}
+}
+
+func hasHookJobs(name string) bool {
+	tx, err := world.store.Begin(false)
+	if err != nil {
+		return true
+	}
+	defer tx.Rollback()
+	bk := tx.Bucket([]byte("hookqueue-" + name))
+	if bk == nil {
+		return false
+	}
+	k, _ := bk.Cursor().First()
+	return k != nil
+}
+
+// deliverDueHook delivers the earliest due job of channel name and reports
+// whether there was one.
+func deliverDueHook(name string) bool {
+	var key []byte
+	var job hookJob
+	var hook webhook
+	var found bool
+
+	tx, err := world.store.Begin(false)
+	if err != nil {
+		logrus.Errorf("hooks: %v", err)
+		return false
+	}
+	if bk := tx.Bucket([]byte("hookqueue-" + name)); bk != nil {
+		k, v := bk.Cursor().First()
+		if len(k) == 16 && int64(binary.BigEndian.Uint64(k)) <= time.Now().Unix() {
+			key = append([]byte{}, k...)
+			job.unmarshal(v)
+			if hooks := tx.Bucket([]byte("hooks-" + name)); hooks != nil {
+				hk := binary.BigEndian.AppendUint64(nil, job.HookID)
+				if v := hooks.Get(hk); len(v) > 0 {
+					found = hook.unmarshal(hk, v) == nil
+				}
+			}
+		}
+	}
+	tx.Rollback()
+	if key == nil {
+		return false
+	}
+
+	var status string
+	if found {
+		job.Attempts++
+		status = hook.deliver(job)
+	}
+
+	tx, err = world.store.Begin(true)
+	if err != nil {
+		logrus.Errorf("hooks: %v", err)
+		return false
+	}
+	defer tx.Rollback()
+	bk, _ := tx.CreateBucketIfNotExists([]byte("hookqueue-" + name))
+	bk.Delete(key)
+	if found {
+		retry := status != "ok" && job.Attempts < maxHookAttempts
+		if retry {
+			backoff := hookBackoff << (job.Attempts - 1)
+			if backoff > hookMaxBackoff {
+				backoff = hookMaxBackoff
+			}
+			putHookJob(bk, time.Now().Add(backoff), job)
+		}
+		logHookDelivery(tx, job, hook, status, retry)
+	}
+	if err := tx.Commit(); err != nil {
+		logrus.Errorf("hooks: %v", err)
+		return false
+	}
+	return true
+}
+
+// deliver posts the job body signed with the webhook secret, it returns "ok"
+// or the reason of failure.
+func (h webhook) deliver(j hookJob) string {
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(j.Body))
+	if err != nil {
+		return err.Error()
+	}
+	mac := hmac.New(sha256.New, []byte(h.Secret))
+	mac.Write(j.Body)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "jpchat-webhook")
+	req.Header.Set("X-JPChat-Event", j.Event)
+	req.Header.Set("X-JPChat-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := hookClient.Do(req)
+	if err != nil {
+		return err.Error()
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return resp.Status
+	}
+	return "ok"
+}
+
+func logHookDelivery(tx *bbolt.Tx, j hookJob, h webhook, status string, retry bool) {
+	bk, _ := tx.CreateBucketIfNotExists([]byte("hooklog-" + j.Channel))
+	seq, _ := bk.NextSequence()
+	v := binary.AppendVarint(nil, time.Now().Unix())
+	v = appendString(v, h.URL)
+	v = appendString(v, j.Event)
+	v = binary.AppendVarint(v, j.Attempts)
+	if retry {
+		status += ", will retry"
+	}
+	v = appendString(v, status)
+	bk.Put(binary.BigEndian.AppendUint64(nil, seq), v)
+	if seq > hookLogSize {
+		bk.Delete(binary.BigEndian.AppendUint64(nil, seq-hookLogSize))
+	}
+}
+
+func listHookLog(name string) (res []map[string]any) {
+	tx, err := world.store.Begin(false)
+	if err != nil {
+		return nil
+	}
+	defer tx.Rollback()
+	if bk := tx.Bucket([]byte("hooklog-" + name)); bk != nil {
+		c := bk.Cursor()
+		for k, v := c.Last(); len(k) > 0; k, v = c.Prev() {
+			r := reader{p: v}
+			ts := r.varint()
+			u, event := string(r.bytes()), string(r.bytes())
+			attempts := r.varint()
+			res = append(res, map[string]any{
+				"time":     time.Unix(ts, 0).Format("01-02 15:04:05"),
+				"url":      u,
+				"event":    event,
+				"attempts": attempts,
+				"status":   string(r.bytes()),
+			})
+		}
+	}
+	return res
+}
+
+func handleHooks(c Ctx) {
+	name := sanitizeChannelName(strings.TrimPrefix(c.URL.Path, "/~hooks/"))
+	if name == "" || isDM(name) { // Admins can read direct messages through hooks otherwise
+		c.WriteHeader(404)
+		return
+	}
+
+	info, _ := getChannelInfo(name)
+	if !c.isOwner(info) {
+		c.WriteHeader(403)
+		c.Printf("Only the owner of #%s can access this page", name)
+		return
+	}
+
+	var msg string
+	if c.Method == "POST" {
+		msg = c.updateHooks(name)
+		if msg == "" {
+			c.Redirect(302, c.URL.Path+"?"+c.URL.RawQuery)
+			return
+		}
+	}
+
+	c.Template("hooks.html", map[string]any{
+		"name":  name,
+		"width": c.width(),
+		"err":   msg,
+		"hooks": listHooks(name),
+		"log":   listHookLog(name),
+		"token": func() string { return makeToken(c) },
+		"theme": c.theme(),
+	})
+}
+
+// updateHooks executes the posted action and returns the error message if any.
+func (c Ctx) updateHooks(name string) string {
+	if validateToken(c, c.FormValue("token")) != 1 {
+		return "Invalid session"
+	}
+
+	tx, err := world.store.Begin(true)
+	if err != nil {
+		logrus.Errorf("hooks: %v", err)
+		return "Internal error"
+	}
+	defer tx.Rollback()
+	bk, _ := tx.CreateBucketIfNotExists([]byte("hooks-" + name))
+
+	var action string
+	switch c.FormValue("op") {
+	case "add":
+		u, err := url.Parse(c.FormValue("url"))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return "Invalid URL"
+		}
+		if bk.Stats().KeyN >= maxHooks {
+			return fmt.Sprintf("At most %d webhooks", maxHooks)
+		}
+		id, _ := bk.NextSequence()
+		h := webhook{URL: u.String(), Secret: hex.EncodeToString(randBytes(16)), By: c.Uid, Created: time.Now().Unix()}
+		bk.Put(binary.BigEndian.AppendUint64(nil, id), h.marshal())
+		action = "add webhook " + h.URL
+	case "delete":
+		var id uint64
+		fmt.Sscan(c.FormValue("id"), &id)
+		bk.Delete(binary.BigEndian.AppendUint64(nil, id))
+		action = fmt.Sprintf("delete webhook %d", id)
+	default:
+		return "Unknown action"
+	}
+	if err := tx.Commit(); err != nil {
+		logrus.Errorf("hooks: %v", err)
+		return "Internal error"
+	}
+	c.audit("#%s %s", name, action)
+	return ""
+}
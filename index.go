@@ -4,9 +4,7 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"html"
-	"net/http"
 	"strconv"
-	"strings"
 	"time"
 	"unicode"
 	"unicode/utf8"
@@ -21,23 +19,11 @@ func handleIndex(c Ctx) {
 			name += "--" + time.Now().Format("0102") + base64.RawURLEncoding.EncodeToString(tmp[:])
 		}
 
-		var pwd string
-		c.Uid, pwd, _ = strings.Cut(c.Query.Get("uid"), "!")
-		if uid := strings.ToLower(c.Uid); strings.Contains(uid, "root") || strings.Contains(uid, "admin") {
-			if !c.isAdmin() {
-				c.Uid = ""
-			}
+		c.Uid = c.Query.Get("uid")
+		if !c.isAdmin() && reservedName(c.Uid) {
+			c.Uid = ""
 		}
 		c.SetUidCookie()
-		if pwd := hmacHex(pwd); pwd == onlineKeyhash {
-			http.SetCookie(c.ResponseWriter, &http.Cookie{
-				Name:     "admin",
-				Value:    pwd,
-				Expires:  time.Now().AddDate(0, 0, 3),
-				HttpOnly: true,
-				Path:     "/",
-			})
-		}
 		c.Query.Del("channel")
 		c.Query.Del("uid")
 		c.Redirect(302, "/"+name+"?"+c.Query.Encode())
@@ -58,28 +44,50 @@ func handleIndex(c Ctx) {
 			}
 		}
 
+		var dms []map[string]any
+		var mentions []mention
+		if c.Verified() {
+			dms = listDMs(c.Uid)
+			if mentions = listMentions(c.Uid); len(mentions) > 10 {
+				mentions = mentions[:10]
+			}
+		}
+
 		c.Template("index.html", map[string]any{
 			"uid":       c.Uid,
+			"user":      c.User,
+			"dms":       dms,
+			"mentions":  mentions,
 			"widths":    [2][2]any{{c.Uid, 400}, {c.Uid, 800}},
 			"totalCh":   totalCh,
 			"activeCh":  activeCh,
 			"totalUser": world.totalUsers.Load(),
 		})
 	} else {
+		if !c.canAccess(name) {
+			c.Redirect(302, "/~unlock/"+name+"?w="+strconv.Itoa(c.width()))
+			return
+		}
+
+		c.saveTimezone()
+		c.saveTheme()
+
 		width, _ := strconv.Atoi(c.Query.Get("w"))
-		width2 := width
-		switch width {
-		case 800:
-			width, width2 = 800, 400
-		default:
-			width, width2 = 400, 800
+		width = screenWidth(width)
+		width2 := screenWidths[1] // Toggles between narrow and wide
+		if width >= width2 {
+			width2 = screenWidths[0]
 		}
 
+		info, _ := getChannelInfo(name)
 		c.Template("channel.html", map[string]any{
 			"uid":    c.Uid,
 			"name":   name,
 			"width":  width,
 			"width2": width2,
+			"mod":    c.isModerator(name, info),
+			"topic":  info.Topic,
+			"theme":  c.theme(),
 		})
 	}
 }
@@ -91,7 +99,7 @@ func handleLink(c Ctx) {
 	var links []string
 	var link string
 
-	if ch, ok := findChannel(name); ok {
+	if ch, ok := findChannel(name); ok && c.canAccess(name) {
 		ch.mu.Lock()
 		links = ch.links
 		ch.mu.Unlock()
@@ -124,6 +132,10 @@ func handleLink(c Ctx) {
 
 func handlePing(c Ctx) {
 	name := sanitizeChannelName(c.URL.Path[7:])
+	if !c.canAccess(name) {
+		c.WriteHeader(403)
+		return
+	}
 	if ch, ok := findChannel(name); ok {
 		ch.mu.Lock()
 		if arr := ch.onlines[c.Uid]; len(arr) > 0 {
@@ -36,16 +36,22 @@ var world struct {
 }
 
 var (
-	domain        = flag.String("d", "", "production")
-	onlineKey     = flag.String("k", "coyove", "production key")
-	onlineKeyhash string
+	domain      = flag.String("d", "", "production")
+	onlineKey   = flag.String("k", "coyove", "production key")
+	historyN    = flag.Int("history-n", 0, "max messages kept per channel, 0 means unlimited")
+	historyAge  = flag.Duration("history-age", 0, "max age of kept messages, 0 means forever")
+	pinsN       = flag.Int("pins-n", 5, "max pinned messages per channel")
+	hookPrivate = flag.Bool("hook-private", false, "allow webhooks to loopback and private addresses")
+	slide       = flag.Bool("slide", false, "animate new messages sliding in, as animated WebP")
+	format      = flag.String("format", "webp", "frame format: webp (lossless when built without cgo), jpeg or png")
+	migrate     = flag.Bool("migrate", false, "convert messages in chat.db to the latest encoding, rebuild search index and exit")
 )
 
 func purgeWorld() {
 	world.Lock()
 	world.totalUsers.Store(0)
 	for k, ch := range world.channels {
-		if ch.Len() == 0 {
+		if ch.Len() == 0 && ch.Subscribers() == 0 {
 			ch.Close()
 			delete(world.channels, k)
 			logrus.Infof("channel %s is empty and purged", ch.Name)
@@ -65,6 +71,21 @@ func findChannel(name string) (*Channel, bool) {
 	return ch, ok
 }
 
+func openChannel(name string) (*Channel, error) {
+	world.Lock()
+	defer world.Unlock()
+	ch, ok := world.channels[name]
+	if !ok {
+		var err error
+		ch, err = loadChannel(name)
+		if err != nil {
+			return nil, err
+		}
+		world.channels[name] = ch
+	}
+	return ch, nil
+}
+
 func main() {
 	flag.Parse()
 
@@ -78,7 +99,12 @@ func main() {
 	logrus.SetFormatter(lf)
 	logrus.SetOutput(lf.out)
 	logrus.SetReportCaller(true)
-	onlineKeyhash = hmacHex(*onlineKey)
+
+	switch *format {
+	case "webp", "jpeg", "png":
+	default:
+		logrus.Fatalf("unknown -format %q, expect webp, jpeg or png", *format)
+	}
 
 	var err error
 	drawFont, err = opentype.Parse(fontData)
@@ -94,12 +120,40 @@ func main() {
 		logrus.Fatal(err)
 	}
 
+	if *migrate {
+		if err := migrateMessages(); err != nil {
+			logrus.Fatal(err)
+		}
+		world.store.Close()
+		return
+	}
+
+	if err := initAdmins(); err != nil {
+		logrus.Fatal(err)
+	}
+
 	purgeWorld()
+	startHooks()
 
 	handle("/", handleIndex)
 	handle("/~send/", handleSend)
 	handle("/~ping/", handlePing)
 	handle("/~link/", handleLink)
+	handle("/~history/", handleHistory)
+	handle("/~edit/", handleEdit)
+	handle("/~search/", handleSearch)
+	handle("/~admin", handleAdmin)
+	handle("/~api/", handleAPI)
+	handle("/~bots", handleBots)
+	handle("/~hooks/", handleHooks)
+	handle("/~settings/", handleSettings)
+	handle("/~pins/", handlePins)
+	handle("/~dm/", handleDM)
+	handle("/~lock/", handleLock)
+	handle("/~unlock/", handleUnlock)
+	handle("/~mod/", handleMod)
+	handle("/~login", handleLogin)
+	handle("/~logout", handleLogout)
 	handle("/~stream", func(c Ctx) {
 		name := c.Query.Get("name")
 		if name == "" {
@@ -107,20 +161,25 @@ func main() {
 			return
 		}
 
-		world.Lock()
-		ch, ok := world.channels[name]
-		if !ok {
-			var err error
-			ch, err = loadChannel(name)
-			if err != nil {
-				world.Unlock()
-				c.WriteHeader(500)
-				logrus.Errorf("load channel: %v", err)
-				return
-			}
-			world.channels[name] = ch
+		if msg := c.accessError(name); msg != "" {
+			c.writeErrorImage(msg)
+			return
+		}
+
+		owner := ""
+		if c.Verified() {
+			owner = c.Uid
+		}
+		if err := createChannel(name, owner); err != nil && err != errDMChannel {
+			logrus.Errorf("create channel: %v", err)
+		}
+
+		ch, err := openChannel(name)
+		if err != nil {
+			c.WriteHeader(500)
+			logrus.Errorf("load channel: %v", err)
+			return
 		}
-		world.Unlock()
 
 		ch.Join(c.Uid, c)
 	})
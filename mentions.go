@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/binary"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/coyove/bbolt"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	maxMentions     = 10 // Per message
+	maxMentionsKept = 50 // Per user
+)
+
+// mention is a message mentioning a registered user, stored in the
+// "mentions-<uid>" bucket keyed by message ID until the user enters its channel.
+type mention struct {
+	ID       uint64
+	Channel  string
+	From     string
+	Text     string
+	UnixTime int64
+}
+
+func (m mention) marshal() (out []byte) {
+	out = appendString(out, m.Channel)
+	out = appendString(out, m.From)
+	out = appendString(out, m.Text)
+	out = binary.AppendVarint(out, m.UnixTime)
+	return
+}
+
+func (m *mention) unmarshal(k, v []byte) error {
+	if len(k) != 8 {
+		return errTruncated
+	}
+	m.ID = binary.BigEndian.Uint64(k)
+	r := reader{p: v}
+	m.Channel = string(r.bytes())
+	m.From = string(r.bytes())
+	m.Text = string(r.bytes())
+	m.UnixTime = r.varint()
+	return r.err
+}
+
+// Where describes the channel of m on the index page.
+func (m mention) Where() string {
+	if isDM(m.Channel) {
+		return "direct message"
+	}
+	return "#" + m.Channel
+}
+
+// isNameRune reports whether r is kept by sanitizeStrict.
+func isNameRune(r rune) bool {
+	if r > 255 {
+		return !unicode.IsSpace(r)
+	}
+	return r == '-' || r == '.' || r == '_' ||
+		('0' <= r && r <= '9') || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z')
+}
+
+// mentionAt returns the nickname mentioned by s[0] == '@' and the length of
+// the mention including '@'.
+func mentionAt(s string) (name string, n int) {
+	if !strings.HasPrefix(s, "@") {
+		return "", 0
+	}
+	n = 1
+	for n < len(s) {
+		r, w := utf8.DecodeRuneInString(s[n:])
+		if !isNameRune(r) || n-1+w > 20 {
+			break
+		}
+		n += w
+	}
+	name = strings.TrimRight(s[1:n], ".") // "@name." ends a sentence
+	return name, len(name) + 1
+}
+
+// parseMentions returns the distinct nicknames written as @name in text.
+func parseMentions(text string) (res []string) {
+	prev := ' '
+	for i := 0; i < len(text) && len(res) < maxMentions; {
+		r, w := utf8.DecodeRuneInString(text[i:])
+		if r == '@' && !isNameRune(prev) {
+			if name, n := mentionAt(text[i:]); name != "" {
+				if !contains(res, name) {
+					res = append(res, name)
+				}
+				i += n
+				prev = 'x'
+				continue
+			}
+		}
+		prev = r
+		i += w
+	}
+	return res
+}
+
+func contains(arr []string, s string) bool {
+	for _, v := range arr {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// recordMentions stores m in the mention list of every registered user it
+// mentions who can read the channel without a passphrase.
+func recordMentions(tx *bbolt.Tx, name string, m Message) {
+	if len(m.Mentions) == 0 {
+		return
+	}
+	info := ChannelInfo{}
+	if bk := tx.Bucket([]byte("channel")); bk != nil {
+		if v := bk.Get([]byte(name)); len(v) >= 8 {
+			info.Unmarshal(v[8:])
+		}
+	}
+	if len(info.PassHash) > 0 {
+		return
+	}
+	users := tx.Bucket([]byte("users"))
+	if users == nil {
+		return
+	}
+
+	text, _, _ := strings.Cut(m.Text, "\n")
+	v := mention{Channel: name, From: m.From, Text: sanitizeLine(text, 120), UnixTime: m.UnixTime}.marshal()
+	for _, uid := range m.Mentions {
+		if uid == m.From || len(users.Get([]byte(uid))) == 0 {
+			continue
+		}
+		if isDM(name) && !contains(info.Members, uid) {
+			continue
+		}
+		bk, _ := tx.CreateBucketIfNotExists([]byte("mentions-" + uid))
+		bk.Put(binary.BigEndian.AppendUint64(nil, m.ID), v)
+
+		var keys [][]byte
+		bk.ForEach(func(k, v []byte) error {
+			keys = append(keys, k)
+			return nil
+		})
+		for i := 0; i < len(keys)-maxMentionsKept; i++ {
+			bk.Delete(keys[i])
+		}
+	}
+}
+
+// clearMentions removes mentions of uid in channel name, they have been seen.
+func clearMentions(uid, name string) {
+	tx, err := world.store.Begin(true)
+	if err != nil {
+		logrus.Errorf("clear mentions: %v", err)
+		return
+	}
+	defer tx.Rollback()
+	bk := tx.Bucket([]byte("mentions-" + uid))
+	if bk == nil {
+		return
+	}
+	var keys [][]byte
+	bk.ForEach(func(k, v []byte) error {
+		m := mention{}
+		if m.unmarshal(k, v) != nil || m.Channel == name {
+			keys = append(keys, k)
+		}
+		return nil
+	})
+	if len(keys) == 0 {
+		return
+	}
+	for _, k := range keys {
+		bk.Delete(k)
+	}
+	if err := tx.Commit(); err != nil {
+		logrus.Errorf("clear mentions: %v", err)
+	}
+}
+
+// listMentions returns the unseen mentions of uid, the latest first.
+func listMentions(uid string) (res []mention) {
+	tx, err := world.store.Begin(false)
+	if err != nil {
+		logrus.Errorf("list mentions: %v", err)
+		return nil
+	}
+	defer tx.Rollback()
+	if bk := tx.Bucket([]byte("mentions-" + uid)); bk != nil {
+		c := bk.Cursor()
+		for k, v := c.Last(); len(k) > 0; k, v = c.Prev() {
+			m := mention{}
+			if m.unmarshal(k, v) == nil {
+				res = append(res, m)
+			}
+		}
+	}
+	return res
+}
+
+// mentioned tells whether uid is mentioned by any of data.
+func mentioned(data []Message, uid string) bool {
+	for _, m := range data {
+		if contains(m.Mentions, uid) {
+			return true
+		}
+	}
+	return false
+}
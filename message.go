@@ -1,45 +1,265 @@
 package main
 
-import "encoding/binary"
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/coyove/bbolt"
+	"github.com/sirupsen/logrus"
+)
 
 type Message struct {
-	ID       uint64
-	From     string
-	UnixTime int64
-	Type     uint64
-	Text     string
+	ID          uint64   `json:"id,string"`
+	From        string   `json:"from"`
+	UnixTime    int64    `json:"time"`
+	Type        uint64   `json:"type"`
+	Text        string   `json:"text"`
+	Target      uint64   `json:"target,omitempty,string"`
+	ReplyTo     uint64   `json:"reply_to,omitempty,string"`
+	EditTime    int64    `json:"edit_time,omitempty"`
+	Flags       uint64   `json:"flags,omitempty"`
+	Attachments []string `json:"attachments,omitempty"`
+	Mentions    []string `json:"mentions,omitempty"` // Parsed from Text by Append
 }
 
 const (
-	MessageText  = 1
-	MessageJoin  = 2
-	MessageLeave = 3
+	MessageText   = 1
+	MessageJoin   = 2
+	MessageLeave  = 3
+	MessageEdit   = 4 // Replace the text of message Target
+	MessageDelete = 5 // Retract message Target
+	MessageSystem = 6 // Output of commands, drawn as "From Text" in one line
+)
+
+const (
+	MessageDeleted = 1 << iota
+	MessageVerified
+	MessageBot // Posted with a bot API token
+)
+
+// Encoding versions. Legacy records start with the big endian ID whose highest
+// bit is never set, so versioned records start with a byte >= 0x80.
+const (
+	messageV1 = 0x81
+)
+
+// Optional fields of v1 records, each one encoded as: tag, length, payload.
+// Decoders skip tags they don't know, so adding fields needs no migration.
+const (
+	tagTarget     = 1
+	tagReplyTo    = 2
+	tagEditTime   = 3
+	tagFlags      = 4
+	tagAttachment = 5 // Repeated
+	tagMention    = 6 // Repeated
 )
 
+var errTruncated = errors.New("message truncated")
+
+// IsOp tells whether m operates on another message instead of being displayed.
+func (m Message) IsOp() bool {
+	return m.Type == MessageEdit || m.Type == MessageDelete
+}
+
 func (m Message) Marshal() (out []byte) {
-	out = binary.BigEndian.AppendUint64(out, m.ID)
-	out = binary.BigEndian.AppendUint64(out, uint64(m.Type))
-	out = binary.BigEndian.AppendUint64(out, uint64(m.UnixTime))
-	out = binary.AppendUvarint(out, uint64(len(m.From)))
-	out = append(out, m.From...)
-	out = binary.AppendUvarint(out, uint64(len(m.Text)))
-	out = append(out, m.Text...)
+	out = append(out, messageV1)
+	out = binary.AppendUvarint(out, m.ID)
+	out = binary.AppendUvarint(out, m.Type)
+	out = binary.AppendVarint(out, m.UnixTime)
+	out = appendString(out, m.From)
+	out = appendString(out, m.Text)
+
+	appendTag := func(tag uint64, payload []byte) {
+		out = binary.AppendUvarint(out, tag)
+		out = appendString(out, string(payload))
+	}
+	if m.Target != 0 {
+		appendTag(tagTarget, binary.AppendUvarint(nil, m.Target))
+	}
+	if m.ReplyTo != 0 {
+		appendTag(tagReplyTo, binary.AppendUvarint(nil, m.ReplyTo))
+	}
+	if m.EditTime != 0 {
+		appendTag(tagEditTime, binary.AppendVarint(nil, m.EditTime))
+	}
+	if m.Flags != 0 {
+		appendTag(tagFlags, binary.AppendUvarint(nil, m.Flags))
+	}
+	for _, a := range m.Attachments {
+		appendTag(tagAttachment, []byte(a))
+	}
+	for _, u := range m.Mentions {
+		appendTag(tagMention, []byte(u))
+	}
 	return
 }
 
 func (m *Message) Unmarshal(p []byte) error {
-	m.ID, p = binary.BigEndian.Uint64(p), p[8:]
-	m.Type, p = binary.BigEndian.Uint64(p), p[8:]
-	m.UnixTime, p = int64(binary.BigEndian.Uint64(p)), p[8:]
-
-	tmp, w := binary.Uvarint(p)
-	p = p[w:]
-	m.From = string(p[:tmp])
-	p = p[tmp:]
-
-	tmp, w = binary.Uvarint(p)
-	p = p[w:]
-	m.Text = string(p[:tmp])
-	p = p[tmp:]
+	*m = Message{}
+	if len(p) == 0 {
+		return errTruncated
+	}
+	if p[0] < 0x80 {
+		return m.unmarshalLegacy(p)
+	}
+	if p[0] != messageV1 {
+		return fmt.Errorf("unknown message version %x", p[0])
+	}
+
+	r := reader{p: p[1:]}
+	m.ID = r.uvarint()
+	m.Type = r.uvarint()
+	m.UnixTime = r.varint()
+	m.From = string(r.bytes())
+	m.Text = string(r.bytes())
+
+	for r.err == nil && len(r.p) > 0 {
+		tag := r.uvarint()
+		payload := reader{p: r.bytes()}
+		switch tag {
+		case tagTarget:
+			m.Target = payload.uvarint()
+		case tagReplyTo:
+			m.ReplyTo = payload.uvarint()
+		case tagEditTime:
+			m.EditTime = payload.varint()
+		case tagFlags:
+			m.Flags = payload.uvarint()
+		case tagAttachment:
+			m.Attachments = append(m.Attachments, string(payload.p))
+		case tagMention:
+			m.Mentions = append(m.Mentions, string(payload.p))
+		}
+		if r.err == nil {
+			r.err = payload.err
+		}
+	}
+	return r.err
+}
+
+// unmarshalLegacy decodes records written before versioning: fixed ID, Type
+// and UnixTime followed by From and Text, then optionally Target, EditTime
+// and Flags.
+func (m *Message) unmarshalLegacy(p []byte) error {
+	if len(p) < 24 {
+		return errTruncated
+	}
+	m.ID = binary.BigEndian.Uint64(p)
+	m.Type = binary.BigEndian.Uint64(p[8:])
+	m.UnixTime = int64(binary.BigEndian.Uint64(p[16:]))
+
+	r := reader{p: p[24:]}
+	m.From = string(r.bytes())
+	m.Text = string(r.bytes())
+	if r.err == nil && len(r.p) > 0 {
+		m.Target = r.uvarint()
+		m.EditTime = r.varint()
+		m.Flags = r.uvarint()
+	}
+	return r.err
+}
+
+func appendString(out []byte, s string) []byte {
+	out = binary.AppendUvarint(out, uint64(len(s)))
+	return append(out, s...)
+}
+
+// reader decodes p sequentially, after the first error all reads return zero.
+type reader struct {
+	p   []byte
+	err error
+}
+
+func (r *reader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, w := binary.Uvarint(r.p)
+	if w <= 0 {
+		r.err = errTruncated
+		return 0
+	}
+	r.p = r.p[w:]
+	return v
+}
+
+func (r *reader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, w := binary.Varint(r.p)
+	if w <= 0 {
+		r.err = errTruncated
+		return 0
+	}
+	r.p = r.p[w:]
+	return v
+}
+
+func (r *reader) bytes() []byte {
+	n := r.uvarint()
+	if r.err != nil {
+		return nil
+	}
+	if n > uint64(len(r.p)) {
+		r.err = errTruncated
+		return nil
+	}
+	v := r.p[:n]
+	r.p = r.p[n:]
+	return v
+}
+
+// migrateMessages rewrites records of all channels in the latest encoding and
+// adds them into the search index.
+func migrateMessages() error {
+	tx, err := world.store.Begin(false)
+	if err != nil {
+		return err
+	}
+	var names [][]byte
+	tx.ForEach(func(name []byte, _ *bbolt.Bucket) error {
+		if bytes.HasPrefix(name, []byte("channel-")) {
+			names = append(names, append([]byte{}, name...))
+		}
+		return nil
+	})
+	tx.Rollback()
+
+	for _, name := range names {
+		tx, err := world.store.Begin(true)
+		if err != nil {
+			return err
+		}
+		bk := tx.Bucket(name)
+
+		var keys, values [][]byte
+		var msgs []Message
+		bk.ForEach(func(k, v []byte) error {
+			m := Message{}
+			if err := m.Unmarshal(v); err != nil {
+				logrus.Errorf("migrate %s %x: %v", name, k, err)
+				return nil
+			}
+			if v[0] != messageV1 {
+				keys, values = append(keys, append([]byte{}, k...)), append(values, m.Marshal())
+			}
+			msgs = append(msgs, m)
+			return nil
+		})
+		for i := range keys {
+			bk.Put(keys[i], values[i])
+		}
+		for _, m := range msgs {
+			indexMessage(tx, string(name[8:]), m, false)
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		logrus.Infof("migrate %s: %d messages converted", name, len(keys))
+	}
 	return nil
 }
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func legacyMarshal(m Message) (out []byte) {
+	out = binary.BigEndian.AppendUint64(out, m.ID)
+	out = binary.BigEndian.AppendUint64(out, uint64(m.Type))
+	out = binary.BigEndian.AppendUint64(out, uint64(m.UnixTime))
+	out = appendString(out, m.From)
+	out = appendString(out, m.Text)
+	return
+}
+
+var testMessages = []Message{
+	{},
+	{ID: 412785382915133560, From: "Wolf1abc", UnixTime: 1792218051, Type: MessageText, Text: "hello\n世界"},
+	{ID: 1, From: "a", Type: MessageEdit, Target: 412785382915133560, Text: "edited", UnixTime: -1},
+	{ID: 2, From: "b", Type: MessageText, ReplyTo: 1, EditTime: 1792218052, Flags: MessageDeleted,
+		Attachments: []string{"https://example.com/a.png", ""}},
+	{ID: 3, From: "c", Type: MessageText, Text: "@a @b", Mentions: []string{"a", "b"}},
+}
+
+func TestMessageMarshal(t *testing.T) {
+	for _, m := range testMessages {
+		var m2 Message
+		if err := m2.Unmarshal(m.Marshal()); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(m, m2) {
+			t.Fatalf("mismatch: %+v and %+v", m, m2)
+		}
+	}
+}
+
+func TestMessageUnmarshalLegacy(t *testing.T) {
+	m := testMessages[1]
+	var m2 Message
+	if err := m2.Unmarshal(legacyMarshal(m)); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m, m2) {
+		t.Fatalf("mismatch: %+v and %+v", m, m2)
+	}
+
+	// Legacy records may carry Target, EditTime and Flags at the end.
+	m.Target, m.EditTime, m.Flags = 3, 4, MessageDeleted
+	p := legacyMarshal(m)
+	p = binary.AppendUvarint(p, m.Target)
+	p = binary.AppendVarint(p, m.EditTime)
+	p = binary.AppendUvarint(p, m.Flags)
+	if err := m2.Unmarshal(p); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m, m2) {
+		t.Fatalf("mismatch: %+v and %+v", m, m2)
+	}
+}
+
+func TestMessageUnmarshalUnknownTag(t *testing.T) {
+	m := testMessages[1]
+	p := m.Marshal()
+	p = binary.AppendUvarint(p, 1000)
+	p = appendString(p, "future field")
+
+	var m2 Message
+	if err := m2.Unmarshal(p); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m, m2) {
+		t.Fatalf("mismatch: %+v and %+v", m, m2)
+	}
+}
+
+func TestMessageUnmarshalTruncated(t *testing.T) {
+	for _, m := range testMessages {
+		for _, p := range [][]byte{m.Marshal(), legacyMarshal(m)} {
+			for i := 0; i < len(p); i++ {
+				var m2 Message
+				if err := m2.Unmarshal(p[:i]); err == nil && reflect.DeepEqual(m, m2) {
+					t.Fatalf("truncated record %x decoded", p[:i])
+				}
+			}
+		}
+	}
+}
+
+func TestParseMentions(t *testing.T) {
+	for text, want := range map[string][]string{
+		"":                          nil,
+		"@":                         nil,
+		"hi @bob":                   {"bob"},
+		"@bob, @Alice. @bob":        {"bob", "Alice"},
+		"mail a@b.com":              nil,
+		"@世界!":                      {"世界"},
+		"(@a_b-c.d.)":               {"a_b-c.d"},
+		"@abcdefghijklmnopqrstuvwx": {"abcdefghijklmnopqrst"},
+	} {
+		if got := parseMentions(text); !reflect.DeepEqual(got, want) {
+			t.Errorf("parseMentions(%q) = %q, want %q", text, got, want)
+		}
+	}
+}
+
+func FuzzMessageUnmarshal(f *testing.F) {
+	for _, m := range testMessages {
+		f.Add(m.Marshal())
+		f.Add(legacyMarshal(m))
+	}
+	f.Fuzz(func(t *testing.T, p []byte) {
+		var m Message
+		if err := m.Unmarshal(p); err != nil {
+			return
+		}
+		var m2 Message
+		if err := m2.Unmarshal(m.Marshal()); err != nil {
+			t.Fatalf("re-decode %+v: %v", m, err)
+		}
+		if !reflect.DeepEqual(m, m2) {
+			t.Fatalf("mismatch: %+v and %+v", m, m2)
+		}
+	})
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	modBan  = "ban"
+	modMute = "mute"
+)
+
+// modEntry is a ban or mute stored in the "mod-<channel>" bucket, keyed by
+// kind and target, where target is either "uid:<uid>" or "ip:<ip>".
+type modEntry struct {
+	Kind   string
+	Target string
+	Label  string
+	By     string
+	Until  int64 // Zero means forever
+}
+
+func (e modEntry) Active() bool {
+	return e.Until == 0 || e.Until > time.Now().Unix()
+}
+
+func (e modEntry) Remaining() string {
+	if e.Until == 0 {
+		return "forever"
+	}
+	return time.Until(time.Unix(e.Until, 0)).Round(time.Second).String()
+}
+
+func (e modEntry) marshal() (out []byte) {
+	out = binary.BigEndian.AppendUint64(out, uint64(e.Until))
+	out = appendString(out, e.Label)
+	out = appendString(out, e.By)
+	return
+}
+
+func (e *modEntry) unmarshal(k, v []byte) error {
+	if len(v) < 8 {
+		return errTruncated
+	}
+	e.Kind, e.Target, _ = strings.Cut(string(k), " ")
+	e.Until = int64(binary.BigEndian.Uint64(v))
+	r := reader{p: v[8:]}
+	e.Label = string(r.bytes())
+	e.By = string(r.bytes())
+	return r.err
+}
+
+func putModEntry(name string, e modEntry) error {
+	tx, err := world.store.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	bk, _ := tx.CreateBucketIfNotExists([]byte("mod-" + name))
+	bk.Put([]byte(e.Kind+" "+e.Target), e.marshal())
+	return tx.Commit()
+}
+
+func deleteModEntry(name, kind, target string) error {
+	tx, err := world.store.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if bk := tx.Bucket([]byte("mod-" + name)); bk != nil {
+		bk.Delete([]byte(kind + " " + target))
+	}
+	return tx.Commit()
+}
+
+func listModEntries(name string) (res []modEntry) {
+	tx, err := world.store.Begin(false)
+	if err != nil {
+		logrus.Errorf("list mod entries: %v", err)
+		return nil
+	}
+	defer tx.Rollback()
+	if bk := tx.Bucket([]byte("mod-" + name)); bk != nil {
+		bk.ForEach(func(k, v []byte) error {
+			e := modEntry{}
+			if e.unmarshal(k, v) == nil && e.Active() {
+				res = append(res, e)
+			}
+			return nil
+		})
+	}
+	return res
+}
+
+// checkMod returns the active entry of kind matching uid or ip in channel name.
+func checkMod(name, kind, uid string, ip net.IP) (e modEntry, ok bool) {
+	tx, err := world.store.Begin(false)
+	if err != nil {
+		logrus.Errorf("check mod entries: %v", err)
+		return e, false
+	}
+	defer tx.Rollback()
+	bk := tx.Bucket([]byte("mod-" + name))
+	if bk == nil {
+		return e, false
+	}
+	for _, target := range []string{"uid:" + uid, "ip:" + ip.String()} {
+		k := []byte(kind + " " + target)
+		if v := bk.Get(k); len(v) > 0 && e.unmarshal(k, v) == nil && e.Active() {
+			return e, true
+		}
+	}
+	return e, false
+}
+
+// Kick disconnects all streams of uid, showing msg to them.
+func (ch *Channel) Kick(uid, msg string) bool {
+	ch.mu.Lock()
+	arr := ch.onlines[uid]
+	for _, state := range arr {
+		state.recv <- channelNotify{
+			kicked: true,
+			data:   makeErrorImage(state.pref, msg),
+			mime:   "image/jpeg",
+		}
+	}
+	ch.mu.Unlock()
+
+	if len(arr) == 0 {
+		return false
+	}
+	logrus.Infof("[Channel %s] %s is kicked: %s", ch.Name, uid, msg)
+	ch.Append(Message{From: uid, Type: MessageLeave})
+	ch.Refresh(-1)
+	return true
+}
+
+func (ch *Channel) onlineIP(uid string) net.IP {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if arr := ch.onlines[uid]; len(arr) > 0 {
+		return arr[len(arr)-1].ip
+	}
+	return nil
+}
+
+func handleMod(c Ctx) {
+	name := sanitizeChannelName(strings.TrimPrefix(c.URL.Path, "/~mod/"))
+	if name == "" || isDM(name) {
+		c.WriteHeader(404)
+		return
+	}
+
+	info, _ := getChannelInfo(name)
+	if !c.isModerator(name, info) {
+		c.WriteHeader(403)
+		c.Printf("Only moderators of #%s can access this page", name)
+		return
+	}
+
+	ch, err := openChannel(name)
+	if err != nil {
+		logrus.Errorf("load channel: %v", err)
+		c.WriteHeader(500)
+		return
+	}
+
+	var msg string
+	if c.Method == "POST" {
+		msg = c.moderate(ch, info)
+		if msg == "" {
+			c.Redirect(302, c.URL.Path+"?"+c.URL.RawQuery)
+			return
+		}
+	}
+
+	ch.mu.Lock()
+	var users []string
+	for uid := range ch.onlines {
+		users = append(users, uid)
+	}
+	ch.mu.Unlock()
+
+	info, _ = getChannelInfo(name)
+	c.Template("mod.html", map[string]any{
+		"name":      name,
+		"width":     c.width(),
+		"err":       msg,
+		"users":     users,
+		"entries":   listModEntries(name),
+		"slowMode":  info.SlowMode,
+		"operators": info.Operators,
+		"owner":     c.isOwner(info),
+		"token":     func() string { return makeToken(c) },
+		"theme":     c.theme(),
+	})
+}
+
+// moderate executes the posted action and returns the error message if any.
+func (c Ctx) moderate(ch *Channel, info ChannelInfo) string {
+	if validateToken(c, c.FormValue("token")) != 1 {
+		return "Invalid session"
+	}
+
+	uid := sanitizeStrict(c.FormValue("uid"), 20)
+	dur, _ := strconv.ParseInt(c.FormValue("dur"), 10, 64)
+
+	op := c.FormValue("op")
+	if (op == "kick" || op == modBan || op == modMute) && uid != "" && uid == info.Owner {
+		return "The owner can't be moderated"
+	}
+
+	var err error
+	switch op {
+	case "kick":
+		if !ch.Kick(uid, "You have been kicked") {
+			return "User not online"
+		}
+	case modBan, modMute:
+		if uid == "" {
+			return "Empty user"
+		}
+		e := modEntry{Kind: op, Target: "uid:" + uid, Label: uid, By: c.Uid}
+		if c.FormValue("by") == "ip" {
+			ip := ch.onlineIP(uid)
+			if ip == nil {
+				return "User not online"
+			}
+			e.Target, e.Label = "ip:"+ip.String(), "IP of "+uid
+		}
+		if dur > 0 {
+			e.Until = time.Now().Unix() + dur
+		}
+		if err = putModEntry(ch.Name, e); err == nil && op == modBan {
+			ch.Kick(uid, "You have been banned")
+		}
+	case "lift":
+		err = deleteModEntry(ch.Name, c.FormValue("kind"), c.FormValue("target"))
+	case "slow":
+		if dur < 0 || dur > 3600 {
+			return "Invalid interval"
+		}
+		err = updateChannelInfo(ch.Name, func(info *ChannelInfo) error {
+			info.SlowMode = dur
+			return nil
+		})
+	case "addop", "delop":
+		if !c.isOwner(info) {
+			return "Only the owner can change operators"
+		}
+		if _, ok := getUser(uid); op == "addop" && !ok {
+			return "Only registered users can be operators"
+		}
+		err = updateChannelInfo(ch.Name, func(info *ChannelInfo) error {
+			ops := info.Operators[:0]
+			for _, o := range info.Operators {
+				if o != uid {
+					ops = append(ops, o)
+				}
+			}
+			if op == "addop" && uid != "" {
+				ops = append(ops, uid)
+			}
+			info.Operators = ops
+			return nil
+		})
+	default:
+		return "Unknown action"
+	}
+	if err != nil {
+		logrus.Errorf("[Channel %s] moderate: %v", ch.Name, err)
+		return "Internal error"
+	}
+	c.audit("#%s %s %s %d", ch.Name, c.FormValue("op"), uid, dur)
+	return ""
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coyove/bbolt"
+	"github.com/sirupsen/logrus"
+)
+
+var errTooManyPins = errors.New("too many pins")
+
+// pin is stored in the "pins-<channel>" bucket keyed by the message ID. It
+// keeps a copy of the message so history trimming never removes it.
+type pin struct {
+	Message
+	By       string
+	PinnedAt int64
+}
+
+func (p pin) marshal() (out []byte) {
+	out = binary.AppendVarint(out, p.PinnedAt)
+	out = appendString(out, p.By)
+	out = appendString(out, string(p.Message.Marshal()))
+	return
+}
+
+func (p *pin) unmarshal(v []byte) error {
+	r := reader{p: v}
+	p.PinnedAt = r.varint()
+	p.By = string(r.bytes())
+	if m := r.bytes(); r.err == nil {
+		return p.Message.Unmarshal(m)
+	}
+	return r.err
+}
+
+// loadPins returns pins of channel name, the most recent one last.
+func loadPins(name string) (res []pin) {
+	tx, err := world.store.Begin(false)
+	if err != nil {
+		logrus.Errorf("load pins: %v", err)
+		return nil
+	}
+	defer tx.Rollback()
+	if bk := tx.Bucket([]byte("pins-" + name)); bk != nil {
+		bk.ForEach(func(k, v []byte) error {
+			p := pin{}
+			if err := p.unmarshal(v); err != nil {
+				logrus.Errorf("[Channel %s] pin %x: %v", name, k, err)
+				return nil
+			}
+			res = append(res, p)
+			return nil
+		})
+	}
+	sort.SliceStable(res, func(i, j int) bool { return res[i].PinnedAt < res[j].PinnedAt })
+	return res
+}
+
+func putPin(name string, m Message, by string) error {
+	tx, err := world.store.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	bk, _ := tx.CreateBucketIfNotExists([]byte("pins-" + name))
+	key := binary.BigEndian.AppendUint64(nil, m.ID)
+	if len(bk.Get(key)) == 0 && bk.Stats().KeyN >= *pinsN {
+		return errTooManyPins
+	}
+	bk.Put(key, pin{Message: m, By: by, PinnedAt: time.Now().Unix()}.marshal())
+	return tx.Commit()
+}
+
+func deletePin(name string, id uint64) (bool, error) {
+	tx, err := world.store.Begin(true)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	bk := tx.Bucket([]byte("pins-" + name))
+	key := binary.BigEndian.AppendUint64(nil, id)
+	if bk == nil || len(bk.Get(key)) == 0 {
+		return false, nil
+	}
+	bk.Delete(key)
+	return true, tx.Commit()
+}
+
+// updatePin refreshes the copy of m if it is pinned, deleted messages are unpinned.
+func updatePin(tx *bbolt.Tx, name string, m Message) bool {
+	bk := tx.Bucket([]byte("pins-" + name))
+	if bk == nil {
+		return false
+	}
+	key := binary.BigEndian.AppendUint64(nil, m.ID)
+	p := pin{}
+	if v := bk.Get(key); len(v) == 0 || p.unmarshal(v) != nil {
+		return false
+	}
+	if m.Flags&MessageDeleted != 0 {
+		bk.Delete(key)
+	} else {
+		p.Message = m
+		bk.Put(key, p.marshal())
+	}
+	return true
+}
+
+// pinsCollapsed tells whether the client prefers the one line pin strip.
+func (c Ctx) pinsCollapsed() bool {
+	ck, _ := c.Cookie("pins")
+	return ck != nil && ck.Value == "0"
+}
+
+func (ch *Channel) reloadPins() {
+	pins := loadPins(ch.Name)
+	ch.mu.Lock()
+	ch.pins = pins
+	ch.mu.Unlock()
+}
+
+func cmdPin(c *Ctx, ch *Channel, info ChannelInfo, args string) (string, bool) {
+	ref, _, ok := parseReply(">>" + strings.TrimPrefix(args, ">>") + " ")
+	if !ok {
+		return "Usage: " + commands["pin"].usage, false
+	}
+	id, ok := ch.resolveReply(ref)
+	m, found := findMessage(ch.Name, id)
+	if !ok || !found || m.Type == MessageSystem || m.Flags&MessageDeleted != 0 {
+		return "Message not found", false
+	}
+	if err := putPin(ch.Name, m, c.Uid); err == errTooManyPins {
+		return "Too many pins, unpin some first", false
+	} else if err != nil {
+		logrus.Errorf("[Channel %s] pin: %v", ch.Name, err)
+		return "Internal error", false
+	}
+	ch.reloadPins()
+	c.audit("#%s pin #%s", ch.Name, m.ShortID())
+	return ch.system(c.Uid, "pinned #"+m.ShortID()), false
+}
+
+func cmdUnpin(c *Ctx, ch *Channel, info ChannelInfo, args string) (string, bool) {
+	ref, _, ok := parseReply(">>" + strings.TrimPrefix(args, ">>") + " ")
+	if !ok {
+		return "Usage: " + commands["unpin"].usage, false
+	}
+	for _, p := range loadPins(ch.Name) {
+		if p.ID&0xFFFF == ref {
+			if _, err := deletePin(ch.Name, p.ID); err != nil {
+				logrus.Errorf("[Channel %s] unpin: %v", ch.Name, err)
+				return "Internal error", false
+			}
+			ch.reloadPins()
+			c.audit("#%s unpin #%s", ch.Name, p.ShortID())
+			return ch.system(c.Uid, "unpinned #"+p.ShortID()), false
+		}
+	}
+	return "Message not pinned", false
+}
+
+func handlePins(c Ctx) {
+	name := sanitizeChannelName(strings.TrimPrefix(c.URL.Path, "/~pins/"))
+	if name == "" {
+		c.WriteHeader(404)
+		return
+	}
+	if !c.canAccess(name) {
+		c.Redirect(302, "/~unlock/"+name+"?w="+strconv.Itoa(c.width()))
+		return
+	}
+
+	info, _ := getChannelInfo(name)
+	mod := c.isModerator(name, info)
+
+	var msg string
+	if c.Method == "POST" && c.FormValue("op") == "collapse" {
+		http.SetCookie(c.ResponseWriter, &http.Cookie{
+			Name:    "pins",
+			Value:   c.FormValue("value"),
+			Expires: time.Now().AddDate(1, 0, 0),
+			Path:    "/",
+		})
+		c.Redirect(302, "/"+name+"?w="+strconv.Itoa(c.width()))
+		return
+	} else if c.Method == "POST" {
+		id, _ := strconv.ParseUint(c.FormValue("id"), 10, 64)
+		if !mod || validateToken(c, c.FormValue("token")) != 1 {
+			msg = "Invalid request"
+		} else if _, err := deletePin(name, id); err != nil {
+			logrus.Errorf("[Channel %s] unpin: %v", name, err)
+			msg = "Internal error"
+		} else {
+			if ch, ok := findChannel(name); ok {
+				ch.reloadPins()
+				ch.Refresh(-1)
+			}
+			c.audit("#%s unpin %d", name, id)
+			c.Redirect(302, c.URL.Path+"?"+c.URL.RawQuery)
+			return
+		}
+	}
+
+	pins := loadPins(name)
+	var items []map[string]any
+	for i := len(pins) - 1; i >= 0; i-- {
+		p := pins[i]
+		items = append(items, map[string]any{
+			"id":    p.ID,
+			"ref":   p.ShortID(),
+			"from":  p.From,
+			"time":  inZone(p.UnixTime, c.timezone()).Format("01-02 15:04:05"),
+			"text":  p.Text,
+			"by":    p.By,
+			"token": makeToken(c),
+		})
+	}
+
+	c.Template("pins.html", map[string]any{
+		"name":      name,
+		"width":     c.width(),
+		"err":       msg,
+		"items":     items,
+		"mod":       mod,
+		"max":       *pinsN,
+		"collapsed": c.pinsCollapsed(),
+		"theme":     c.theme(),
+	})
+}
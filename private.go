@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func passCookieName(name string) string {
+	return fmt.Sprintf("pass-%08x", crc32.ChecksumIEEE([]byte(name)))
+}
+
+// passToken is granted after entering the passphrase, changing the passphrase
+// invalidates all tokens issued before.
+func passToken(name string, passHash []byte) string {
+	return hmacHex(name + "\x00" + string(passHash))
+}
+
+func (c Ctx) setPassCookie(name string, passHash []byte) {
+	http.SetCookie(c.ResponseWriter, &http.Cookie{
+		Name:     passCookieName(name),
+		Value:    passToken(name, passHash),
+		Expires:  time.Now().AddDate(0, 1, 0),
+		HttpOnly: true,
+		Path:     "/",
+	})
+}
+
+// canAccess tells whether c can read and write channel name.
+func (c Ctx) canAccess(name string) bool {
+	info, _ := getChannelInfo(name)
+	if isDM(name) {
+		return c.isMember(info)
+	}
+	if len(info.PassHash) == 0 || c.isAdmin() {
+		return true
+	}
+	ck, _ := c.Cookie(passCookieName(name))
+	return ck != nil && hmac.Equal([]byte(ck.Value), []byte(passToken(name, info.PassHash)))
+}
+
+// accessError tells why c can't join channel name, empty if c can.
+func (c Ctx) accessError(name string) string {
+	if !c.canAccess(name) {
+		if isDM(name) {
+			return "Direct messages are private"
+		}
+		return "Passphrase required"
+	}
+	if e, ok := checkMod(name, modBan, c.Uid, c.IP); ok {
+		return "You are banned, remaining " + e.Remaining()
+	}
+	return ""
+}
+
+// isOwner reports whether c is an admin or the registered user who created the
+// channel, anonymous nicknames can be taken by anyone and never own channels.
+func (c Ctx) isOwner(info ChannelInfo) bool {
+	return c.isAdmin() || (info.Owner != "" && c.Verified() && info.Owner == c.Uid)
+}
+
+func (c Ctx) isModerator(name string, info ChannelInfo) bool {
+	if c.isOwner(info) || (c.Admin != nil && c.Admin.Account.moderates(name)) {
+		return true
+	}
+	for _, op := range info.Operators {
+		if op == c.Uid && c.Verified() {
+			return true
+		}
+	}
+	return false
+}
+
+func handleUnlock(c Ctx) {
+	name := sanitizeChannelName(strings.TrimPrefix(c.URL.Path, "/~unlock/"))
+	if name == "" {
+		c.WriteHeader(404)
+		return
+	}
+
+	if isDM(name) {
+		c.WriteHeader(403)
+		c.Printf("Direct messages are private")
+		return
+	}
+
+	var msg string
+	if c.Method == "POST" {
+		info, _ := getChannelInfo(name)
+		if !c.CheckIP("~unlock") {
+			msg = "Cooling down"
+		} else if c.AddIP("~unlock", time.Second); len(info.PassHash) > 0 &&
+			bcrypt.CompareHashAndPassword(info.PassHash, []byte(c.FormValue("pass"))) != nil {
+			msg = "Wrong passphrase"
+		} else {
+			c.setPassCookie(name, info.PassHash)
+			c.Redirect(302, "/"+name+"?w="+strconv.Itoa(c.width()))
+			return
+		}
+	}
+
+	c.Template("passphrase.html", map[string]any{
+		"name":  name,
+		"width": c.width(),
+		"err":   msg,
+		"theme": c.theme(),
+	})
+}
+
+// lockOut kicks everyone but keep and closes API streams, so they need the new
+// passphrase to come back.
+func (ch *Channel) lockOut(keep, msg string) {
+	ch.mu.Lock()
+	var uids []string
+	for uid := range ch.onlines {
+		if uid != keep {
+			uids = append(uids, uid)
+		}
+	}
+	for sub := range ch.subs {
+		delete(ch.subs, sub)
+		close(sub)
+	}
+	ch.mu.Unlock()
+
+	for _, uid := range uids {
+		ch.Kick(uid, msg)
+	}
+}
+
+func handleLock(c Ctx) {
+	name := sanitizeChannelName(strings.TrimPrefix(c.URL.Path, "/~lock/"))
+	if name == "" || isDM(name) {
+		c.WriteHeader(404)
+		return
+	}
+
+	info, _ := getChannelInfo(name)
+	if !c.isOwner(info) {
+		c.WriteHeader(403)
+		c.Printf("Only the owner of #%s can change its passphrase", name)
+		return
+	}
+
+	var msg string
+	if c.Method == "POST" {
+		pass := c.FormValue("pass")
+		switch {
+		case validateToken(c, c.FormValue("token")) != 1:
+			msg = "Invalid session"
+		case pass != c.FormValue("pass2"):
+			msg = "Passphrases don't match"
+		case len(pass) > 72:
+			msg = "Passphrase too long"
+		default:
+			var hash []byte
+			if pass != "" {
+				hash, _ = bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+			}
+			if err := updateChannelInfo(name, func(info *ChannelInfo) error {
+				info.PassHash = hash
+				return nil
+			}); err != nil {
+				logrus.Errorf("lock channel %s: %v", name, err)
+				msg = "Internal error"
+				break
+			}
+			logrus.Infof("[Channel %s] passphrase changed by %s", name, c.Uid)
+			if ch, ok := findChannel(name); ok && hash != nil {
+				ch.lockOut(c.Uid, "Passphrase changed, please reload")
+			}
+			c.setPassCookie(name, hash)
+			c.Redirect(302, "/"+name+"?w="+strconv.Itoa(c.width()))
+			return
+		}
+	}
+
+	c.Template("passphrase.html", map[string]any{
+		"name":   name,
+		"width":  c.width(),
+		"err":    msg,
+		"lock":   true,
+		"locked": len(info.PassHash) > 0,
+		"token":  makeToken(c),
+		"theme":  c.theme(),
+	})
+}
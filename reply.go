@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+)
+
+// ShortID is the reference shown on screen, it is unique among the latest 65536
+// messages of a channel and is what ">>" replies refer to.
+func (m Message) ShortID() string {
+	return fmt.Sprintf("%04x", m.ID&0xFFFF)
+}
+
+// parseReply splits ">>ref text" into ref and text.
+func parseReply(msg string) (ref uint64, text string, ok bool) {
+	if !strings.HasPrefix(msg, ">>") {
+		return 0, msg, false
+	}
+	head, text := msg[2:], ""
+	if idx := strings.IndexAny(head, " \n"); idx >= 0 {
+		head, text = head[:idx], head[idx+1:]
+	}
+	head = strings.TrimPrefix(head, "#")
+	if len(head) == 0 || len(head) > 4 {
+		return 0, msg, false
+	}
+	ref, err := strconv.ParseUint(head, 16, 16)
+	if err != nil {
+		return 0, msg, false
+	}
+	return ref, strings.TrimSpace(text), true
+}
+
+// resolveReply finds the latest on screen message whose ShortID is ref.
+func (ch *Channel) resolveReply(ref uint64) (uint64, bool) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	for i := len(ch.data) - 1; i >= 0; i-- {
+		m := ch.data[i]
+		if m.ID&0xFFFF == ref && m.Type != MessageJoin && m.Type != MessageLeave {
+			return m.ID, true
+		}
+	}
+	return 0, false
+}
+
+// quoteText returns the single line snippet of parent that fits in max.
+func quoteText(d *font.Drawer, parent Message, found bool, max fixed.Int26_6) string {
+	var text string
+	switch {
+	case !found:
+		return "↪ #" + parent.ShortID()
+	case parent.Flags&MessageDeleted != 0:
+		text = "message deleted"
+	default:
+		text, _, _ = strings.Cut(parent.Text, "\n")
+	}
+	return truncateText(d, "↪ "+parent.From+": "+text, max)
+}
+
+// truncateText cuts text to fit in max and appends "…" if needed.
+func truncateText(d *font.Drawer, text string, max fixed.Int26_6) string {
+	var x fixed.Int26_6
+	scale := faceScale(d.Face)
+	for i := 0; i < len(text); {
+		c, cw := utf8.DecodeRuneInString(text[i:])
+		if cand, isEmoji := probeEmoji(c, text[i+cw:]); isEmoji {
+			x += fixed.I(emojiAdvance * scale)
+			cw += len(cand.text)
+		} else if _, _, ok := d.Face.GlyphBounds(c); !ok && c < 0x10000 {
+			x += fixed.I(18 * scale)
+		} else {
+			advance, _ := d.Face.GlyphAdvance(c)
+			x += advance
+		}
+		if x > max {
+			return text[:i] + "…"
+		}
+		i += cw
+	}
+	return text
+}
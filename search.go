@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/coyove/bbolt"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	searchResults    = 50
+	searchCandidates = 5000
+)
+
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// tokenize splits text into lowercased words. CJK runs have no word boundaries,
+// so every character and every pair of adjacent characters becomes a token.
+func tokenize(text string) (res []string) {
+	dedup := map[string]bool{}
+	add := func(tok string) {
+		if tok != "" && !dedup[tok] {
+			dedup[tok] = true
+			res = append(res, tok)
+		}
+	}
+
+	var word []rune
+	var prev rune = -1
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case isCJK(r):
+			add(string(word))
+			word = word[:0]
+			add(string(r))
+			if prev >= 0 {
+				add(string([]rune{prev, r}))
+			}
+			prev = r
+			continue
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r):
+			word = append(word, r)
+		default:
+			add(string(word))
+			word = word[:0]
+		}
+		prev = -1
+	}
+	add(string(word))
+	return res
+}
+
+func indexKey(tok string, id uint64) []byte {
+	return binary.BigEndian.AppendUint64(append([]byte(tok), 0), id)
+}
+
+// indexMessage adds m into the inverted index of channel name, or removes it.
+func indexMessage(tx *bbolt.Tx, name string, m Message, remove bool) {
+	if m.IsOp() || m.Type == MessageJoin || m.Type == MessageLeave {
+		return
+	}
+	if remove {
+		bk := tx.Bucket([]byte("index-" + name))
+		if bk == nil {
+			return
+		}
+		for _, tok := range tokenize(m.Text) {
+			bk.Delete(indexKey(tok, m.ID))
+		}
+		return
+	}
+	bk, _ := tx.CreateBucketIfNotExists([]byte("index-" + name))
+	for _, tok := range tokenize(m.Text) {
+		bk.Put(indexKey(tok, m.ID), nil)
+	}
+}
+
+// searchMessages returns messages of channel name containing all tokens of q,
+// newest first.
+func searchMessages(name string, q string) (res []Message, err error) {
+	toks := tokenize(q)
+	if len(toks) == 0 {
+		return nil, nil
+	}
+
+	tx, err := world.store.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	idx := tx.Bucket([]byte("index-" + name))
+	bk := tx.Bucket([]byte("channel-" + name))
+	if idx == nil || bk == nil {
+		return nil, nil
+	}
+
+	prefix := append([]byte(toks[0]), 0)
+	c := idx.Cursor()
+	k, _ := c.Seek(append([]byte(toks[0]), 1))
+	if len(k) > 0 {
+		k, _ = c.Prev()
+	} else {
+		k, _ = c.Last()
+	}
+
+NEXT:
+	for n := 0; bytes.HasPrefix(k, prefix) && n < searchCandidates && len(res) < searchResults; k, _ = c.Prev() {
+		n++
+		id := binary.BigEndian.Uint64(k[len(prefix):])
+		for _, tok := range toks[1:] {
+			if idx.Get(indexKey(tok, id)) == nil {
+				continue NEXT
+			}
+		}
+
+		// Edits don't remove stale tokens, check the current text again.
+		v := bk.Get(k[len(prefix):])
+		m := Message{}
+		if len(v) == 0 || m.Unmarshal(v) != nil || m.Flags&MessageDeleted != 0 {
+			continue
+		}
+		current := map[string]bool{}
+		for _, tok := range tokenize(m.Text) {
+			current[tok] = true
+		}
+		for _, tok := range toks {
+			if !current[tok] {
+				continue NEXT
+			}
+		}
+		res = append(res, m)
+	}
+	return res, nil
+}
+
+func handleSearch(c Ctx) {
+	name := sanitizeChannelName(c.URL.Path[9:])
+	if name == "" {
+		c.WriteHeader(404)
+		return
+	}
+	if !c.canAccess(name) {
+		c.Redirect(302, "/~unlock/"+name+"?w="+strconv.Itoa(c.width()))
+		return
+	}
+
+	q := strings.TrimSpace(c.Query.Get("q"))
+	if len(q) > 100 {
+		q = q[:100]
+	}
+
+	var items []map[string]any
+	if q != "" {
+		res, err := searchMessages(name, q)
+		if err != nil {
+			logrus.Errorf("search %s: %v", name, err)
+			c.WriteHeader(500)
+			return
+		}
+		for _, m := range res {
+			items = append(items, map[string]any{
+				"from":   m.From,
+				"time":   inZone(m.UnixTime, c.timezone()).Format("2006-01-02 15:04:05"),
+				"text":   m.Text,
+				"before": m.ID + 1,
+			})
+		}
+	}
+
+	c.Template("search.html", map[string]any{
+		"name":  name,
+		"width": c.width(),
+		"q":     q,
+		"items": items,
+		"theme": c.theme(),
+	})
+}
@@ -8,6 +8,7 @@ import (
 	"crypto/sha1"
 	"encoding/binary"
 	"encoding/hex"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -80,16 +81,28 @@ func validateToken(c Ctx, tok string) int {
 
 func handleSend(c Ctx) {
 	var name string
-	var err string
+	var err, notice string
 	if c.Method == "POST" {
 		name = sanitizeChannelName(c.FormValue("channel"))
 		msg := sanitizeMessage(c.FormValue("msg"))
 
-		if !c.CheckIP() {
-			err = "Cooling down"
+		if err = c.accessError(name); err != "" {
 			goto NO_SEND
 		}
-		c.AddIP()
+
+		info, _ := getChannelInfo(name)
+		if e, muted := checkMod(name, modMute, c.Uid, c.IP); muted {
+			err = "You are muted, remaining " + e.Remaining()
+			goto NO_SEND
+		}
+
+		if !c.isModerator(name, info) {
+			if !c.CheckIP(name) {
+				err = "Cooling down"
+				goto NO_SEND
+			}
+			c.AddIP(name, info.Cooldown())
+		}
 
 		tok := c.FormValue("token")
 		switch res := validateToken(c, tok); res {
@@ -106,10 +119,36 @@ func handleSend(c Ctx) {
 		ch, ok := world.channels[name]
 		world.Unlock()
 
+		if cmd, args, isCmd := parseCommand(msg); isCmd && ok {
+			if res, isNotice := c.runCommand(ch, info, cmd, args); isNotice {
+				notice = res
+			} else {
+				err = res
+			}
+			goto NO_SEND
+		} else if strings.HasPrefix(msg, "//") {
+			msg = msg[1:]
+		}
+
+		var replyTo uint64
+		if ref, text, isReply := parseReply(msg); isReply && ok {
+			if replyTo, isReply = ch.resolveReply(ref); isReply {
+				msg = text
+			}
+		}
+
+		var flags uint64
+		if c.Verified() {
+			flags |= MessageVerified
+		}
+
 		if len(msg) > 0 && ok {
 			e := ch.Append(Message{
-				From: c.Uid,
-				Text: msg,
+				From:    c.Uid,
+				Type:    MessageText,
+				Text:    msg,
+				ReplyTo: replyTo,
+				Flags:   flags,
 			})
 			if e == nil {
 				ch.Refresh(-1)
@@ -120,6 +159,7 @@ func handleSend(c Ctx) {
 		}
 	} else {
 		name = sanitizeChannelName(c.URL.Path[7:])
+		err = c.accessError(name)
 	}
 
 NO_SEND:
@@ -129,11 +169,13 @@ NO_SEND:
 	}
 
 	c.Template("send.html", map[string]any{
-		"name":  name,
-		"uid":   c.Uid,
-		"multi": c.Query.Get("multi") != "",
-		"err":   err,
-		"token": makeToken(c),
-		"width": c.Query.Get("width"),
+		"name":   name,
+		"uid":    c.Uid,
+		"multi":  c.Query.Get("multi") != "",
+		"err":    err,
+		"notice": notice,
+		"token":  makeToken(c),
+		"width":  c.Query.Get("width"),
+		"theme":  c.theme(),
 	})
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"image"
+
+	"github.com/chai2010/webp"
+)
+
+const (
+	slideFrames = 4
+	slideDelay  = 50 // Milliseconds per frame
+)
+
+func pixRow(m *image.RGBA, y int) []byte {
+	return m.Pix[y*m.Stride : (y+1)*m.Stride]
+}
+
+// scrollOffset compares rows above y1 of two frames, the messages of img are
+// those of old moved up by d rows from y0 on. Rows above y1-d-seam, where the
+// newest message may overlap the rest, must match entirely and be at least
+// minOverlap. It returns 0 if they didn't simply scroll.
+func scrollOffset(old, img *image.RGBA, y1, seam, minOverlap int) (y0, d int) {
+	for y0 < y1 && bytes.Equal(pixRow(old, y0), pixRow(img, y0)) {
+		y0++
+	}
+	for d = 1; y1-d-seam-y0 >= minOverlap; d++ {
+		y := y0
+		for y < y1-d-seam && bytes.Equal(pixRow(img, y), pixRow(old, y+d)) {
+			y++
+		}
+		if y == y1-d-seam {
+			return y0, d
+		}
+	}
+	return y0, 0
+}
+
+// encodeSlide animates the messages of old scrolling up until img, the bottom
+// bar is taken from img. It returns nil if img isn't old scrolled.
+func (ch *Channel) encodeSlide(old, img *image.RGBA, v view, q int) []byte {
+	y1 := img.Rect.Dy() - lineHeight*v.scale*3/2 // Top of the bottom bar
+	y0, d := scrollOffset(old, img, y1, lineHeight*v.scale/2, lineHeight*v.scale)
+	if d == 0 {
+		return nil
+	}
+
+	anim := &webp.Animation{LoopCount: 1}
+	for k := 1; k < slideFrames; k++ {
+		n := slideFrames - k
+		s := d - d*n*n/(slideFrames*slideFrames) // Ease out
+		m := image.NewRGBA(img.Rect)
+		copy(m.Pix, img.Pix)
+		for y := y0; y < y1; y++ {
+			if y+s < y1 {
+				copy(pixRow(m, y), pixRow(old, y+s))
+			} else {
+				copy(pixRow(m, y), pixRow(img, y+s-d))
+			}
+		}
+		anim.Image = append(anim.Image, m)
+		anim.Delay = append(anim.Delay, slideDelay)
+	}
+	anim.Image = append(anim.Image, img)
+	anim.Delay = append(anim.Delay, slideDelay*10)
+
+	out := bytes.Buffer{}
+	if err := webp.EncodeAll(&out, anim, &webp.Options{Quality: float32(q)}); err != nil {
+		return nil
+	}
+	return out.Bytes()
+}
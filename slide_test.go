@@ -0,0 +1,46 @@
+package main
+
+import (
+	"image"
+	"testing"
+)
+
+func TestScrollOffset(t *testing.T) {
+	const h, y0, y1, d = 40, 5, 30, 4
+	row := func(m *image.RGBA, y int, v byte) {
+		for i := range pixRow(m, y) {
+			pixRow(m, y)[i] = v
+		}
+	}
+	old := image.NewRGBA(image.Rect(0, 0, 2, h))
+	img := image.NewRGBA(old.Rect)
+	for y := 0; y < h; y++ {
+		row(old, y, byte(y))
+		switch {
+		case y < y0 || y >= y1: // Header and bottom bar
+			row(img, y, byte(y))
+		case y < y1-d:
+			row(img, y, byte(y+d))
+		default:
+			row(img, y, 200)
+		}
+	}
+
+	if a, b := scrollOffset(old, img, y1, 0, 10); a != y0 || b != d {
+		t.Fatal(a, b)
+	}
+
+	row(img, y1-d-1, 201) // The new message overlaps the row above it
+	if _, b := scrollOffset(old, img, y1, 0, 10); b != 0 {
+		t.Fatal(b)
+	}
+	if a, b := scrollOffset(old, img, y1, 2, 10); a != y0 || b != d {
+		t.Fatal(a, b)
+	}
+	if _, b := scrollOffset(old, img, y1, 2, 20); b != 0 { // Too few rows left
+		t.Fatal(b)
+	}
+	if _, b := scrollOffset(old, old, y1, 0, 10); b != 0 {
+		t.Fatal(b)
+	}
+}
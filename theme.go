@@ -0,0 +1,109 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"net/http"
+	"time"
+)
+
+// theme is the palette of rendered frames and the pages around them.
+type theme struct {
+	Name string
+
+	bg        *image.Uniform // Background
+	text      *image.Uniform
+	dim       *image.Uniform // Secondary text: refs, quotes, badges
+	nick      *image.Uniform // Nicknames and mentions
+	row       *image.Uniform // Every other message, pin strip and history bar
+	shade     *image.Uniform // Badges and the user count
+	rule      *image.Uniform // Quote bars and bottom lines
+	bar       *image.Uniform // Topic band and bottom bar
+	bar2      *image.Uniform // Bottom lines of bar
+	highlight *image.Uniform // Messages mentioning the viewer
+
+	CSS string // Overrides variables of main.css
+}
+
+func uniform(r, g, b uint8) *image.Uniform {
+	return image.NewUniform(color.RGBA{r, g, b, 255})
+}
+
+var (
+	themeLight = &theme{
+		Name:      "light",
+		bg:        uniform(255, 255, 255),
+		text:      uniform(0, 0, 0),
+		dim:       uniform(120, 120, 120),
+		nick:      uniform(0, 0, 255),
+		row:       uniform(245, 245, 245),
+		shade:     uniform(200, 200, 200),
+		rule:      uniform(180, 180, 180),
+		bar:       uniform(0xff, 0xec, 0xb3),
+		bar2:      uniform(0xee, 0xdb, 0xa2),
+		highlight: uniform(0xff, 0xf8, 0xe1),
+	}
+
+	themeDark = &theme{
+		Name:      "dark",
+		bg:        uniform(30, 31, 34),
+		text:      uniform(220, 221, 222),
+		dim:       uniform(140, 142, 148),
+		nick:      uniform(122, 162, 255),
+		row:       uniform(40, 42, 46),
+		shade:     uniform(64, 66, 72),
+		rule:      uniform(90, 92, 98),
+		bar:       uniform(52, 47, 33),
+		bar2:      uniform(78, 70, 48),
+		highlight: uniform(66, 56, 28),
+		CSS: `:root { --page: #151618; --panel: #1e1f22; --input: #2b2d31; --text: #dcddde;
+			--link: #7aa2ff; --button: #dcddde; --dim: #8c8e94; --nick: #7aa2ff; color-scheme: dark }`,
+	}
+
+	themeContrast = &theme{
+		Name:      "contrast",
+		bg:        uniform(0, 0, 0),
+		text:      uniform(255, 255, 255),
+		dim:       uniform(210, 210, 210),
+		nick:      uniform(255, 255, 0),
+		row:       uniform(28, 28, 28),
+		shade:     uniform(90, 90, 90),
+		rule:      uniform(255, 255, 255),
+		bar:       uniform(0, 0, 110),
+		bar2:      uniform(255, 255, 255),
+		highlight: uniform(100, 0, 100),
+		CSS: `:root { --page: black; --panel: black; --input: black; --text: white;
+			--link: yellow; --button: white; --dim: #d2d2d2; --nick: yellow; color-scheme: dark }
+			input, textarea { border: solid 1px white !important }`,
+	}
+
+	themes = map[string]*theme{
+		themeLight.Name:    themeLight,
+		themeDark.Name:     themeDark,
+		themeContrast.Name: themeContrast,
+	}
+)
+
+// theme returns the theme of the client from the "theme" query parameter or
+// cookie, defaulting to light.
+func (c Ctx) theme() *theme {
+	if t := themes[c.Query.Get("theme")]; t != nil {
+		return t
+	}
+	if ck, _ := c.Cookie("theme"); ck != nil && themes[ck.Value] != nil {
+		return themes[ck.Value]
+	}
+	return themeLight
+}
+
+// saveTheme remembers a valid "theme" query parameter in the cookie.
+func (c Ctx) saveTheme() {
+	if t := themes[c.Query.Get("theme")]; t != nil {
+		http.SetCookie(c.ResponseWriter, &http.Cookie{
+			Name:    "theme",
+			Value:   t.Name,
+			Expires: time.Now().AddDate(1, 0, 0),
+			Path:    "/",
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	maxTopic       = 100
+	maxDescription = 300
+)
+
+// sanitizeLine folds text into one line of at most max bytes.
+func sanitizeLine(in string, max int) string {
+	in = strings.Join(strings.Fields(in), " ")
+	if len(in) > max {
+		in = strings.ToValidUTF8(in[:max], "")
+	}
+	return in
+}
+
+// setHeader updates the topic band of ch, if it is loaded, after its info
+// has been changed.
+func setHeader(name string, info ChannelInfo) {
+	if ch, ok := findChannel(name); ok {
+		ch.mu.Lock()
+		ch.topic, ch.description = info.Topic, info.Description
+		ch.mu.Unlock()
+		ch.Refresh(-1)
+	}
+}
+
+func setTopic(name, topic, description string) error {
+	var info ChannelInfo
+	err := updateChannelInfo(name, func(v *ChannelInfo) error {
+		v.Topic, v.Description = topic, description
+		info = *v
+		return nil
+	})
+	if err == nil {
+		setHeader(name, info)
+	}
+	return err
+}
+
+func handleSettings(c Ctx) {
+	name := sanitizeChannelName(strings.TrimPrefix(c.URL.Path, "/~settings/"))
+	if name == "" || isDM(name) {
+		c.WriteHeader(404)
+		return
+	}
+
+	info, _ := getChannelInfo(name)
+	if !c.isOwner(info) {
+		c.WriteHeader(403)
+		c.Printf("Only the owner of #%s can access this page", name)
+		return
+	}
+
+	var msg string
+	if c.Method == "POST" {
+		topic := sanitizeLine(c.FormValue("topic"), maxTopic)
+		desc := sanitizeLine(c.FormValue("description"), maxDescription)
+		if validateToken(c, c.FormValue("token")) != 1 {
+			msg = "Invalid session"
+		} else if err := setTopic(name, topic, desc); err != nil {
+			logrus.Errorf("[Channel %s] settings: %v", name, err)
+			msg = "Internal error"
+		} else {
+			c.audit("#%s set topic %q", name, topic)
+			c.Redirect(302, "/"+name+"?w="+strconv.Itoa(c.width()))
+			return
+		}
+		info.Topic, info.Description = topic, desc
+	}
+
+	c.Template("settings.html", map[string]any{
+		"name":        name,
+		"width":       c.width(),
+		"err":         msg,
+		"topic":       info.Topic,
+		"description": info.Description,
+		"token":       makeToken(c),
+		"theme":       c.theme(),
+	})
+}
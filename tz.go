@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	_ "time/tzdata" // Servers may lack zoneinfo
+)
+
+// langZones guesses the timezone of Accept-Language tags, regions are tried
+// before bare languages.
+var langZones = map[string]string{
+	"ja": "Asia/Tokyo", "ko": "Asia/Seoul",
+	"zh": "Asia/Shanghai", "zh-tw": "Asia/Taipei", "zh-hk": "Asia/Hong_Kong", "zh-hant": "Asia/Taipei",
+	"en-gb": "Europe/London", "en-ie": "Europe/Dublin", "en-au": "Australia/Sydney",
+	"en-nz": "Pacific/Auckland", "en-in": "Asia/Kolkata", "en-ca": "America/Toronto",
+	"en-us": "America/New_York", "en-sg": "Asia/Singapore", "hi": "Asia/Kolkata",
+	"de": "Europe/Berlin", "fr": "Europe/Paris", "it": "Europe/Rome", "nl": "Europe/Amsterdam",
+	"es": "Europe/Madrid", "es-mx": "America/Mexico_City", "es-ar": "America/Argentina/Buenos_Aires",
+	"pt": "Europe/Lisbon", "pt-br": "America/Sao_Paulo", "pl": "Europe/Warsaw", "sv": "Europe/Stockholm",
+	"ru": "Europe/Moscow", "uk": "Europe/Kyiv", "tr": "Europe/Istanbul",
+	"th": "Asia/Bangkok", "vi": "Asia/Ho_Chi_Minh", "id": "Asia/Jakarta",
+}
+
+var locations sync.Map // Name to *time.Location
+
+// loadLocation returns the shared *time.Location of name, so equal zones
+// compare equal in views.
+func loadLocation(name string) *time.Location {
+	if name == "" || len(name) > 64 {
+		return nil
+	}
+	if loc, ok := locations.Load(name); ok {
+		return loc.(*time.Location)
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil || loc == time.Local {
+		return nil
+	}
+	v, _ := locations.LoadOrStore(name, loc)
+	return v.(*time.Location)
+}
+
+// timezone returns the zone of the client from the "tz" query parameter or
+// cookie, or guesses it from Accept-Language. It returns nil if unknown, which
+// means the server's zone.
+func (c Ctx) timezone() *time.Location {
+	if loc := loadLocation(c.Query.Get("tz")); loc != nil {
+		return loc
+	}
+	if ck, _ := c.Cookie("tz"); ck != nil {
+		if loc := loadLocation(ck.Value); loc != nil {
+			return loc
+		}
+	}
+	for _, tag := range strings.Split(c.Request.Header.Get("Accept-Language"), ",") {
+		tag, _, _ = strings.Cut(strings.ToLower(strings.TrimSpace(tag)), ";")
+		if zone, ok := langZones[tag]; ok {
+			return loadLocation(zone)
+		}
+		if lang, _, ok := strings.Cut(tag, "-"); ok && langZones[lang] != "" {
+			return loadLocation(langZones[lang])
+		}
+	}
+	return nil
+}
+
+// saveTimezone remembers a valid "tz" query parameter in the cookie.
+func (c Ctx) saveTimezone() {
+	if loc := loadLocation(c.Query.Get("tz")); loc != nil {
+		http.SetCookie(c.ResponseWriter, &http.Cookie{
+			Name:    "tz",
+			Value:   loc.String(),
+			Expires: time.Now().AddDate(1, 0, 0),
+			Path:    "/",
+		})
+	}
+}
+
+// inZone converts unix seconds to loc, nil is the server's zone.
+func inZone(ts int64, loc *time.Location) time.Time {
+	if loc == nil {
+		return time.Unix(ts, 0)
+	}
+	return time.Unix(ts, 0).In(loc)
+}
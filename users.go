@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/binary"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const authCookieAge = 30 * 86400
+
+// userRecord is stored in the "users" bucket keyed by the registered nickname.
+type userRecord struct {
+	PassHash []byte
+	Created  int64
+}
+
+func (u userRecord) marshal() (out []byte) {
+	out = binary.AppendVarint(out, u.Created)
+	out = appendString(out, string(u.PassHash))
+	return
+}
+
+func (u *userRecord) unmarshal(p []byte) error {
+	r := reader{p: p}
+	u.Created = r.varint()
+	u.PassHash = append([]byte{}, r.bytes()...)
+	return r.err
+}
+
+// reservedName reports whether name looks like staff, only admins can use it.
+func reservedName(name string) bool {
+	lower := strings.ToLower(name)
+	return strings.Contains(lower, "root") || strings.Contains(lower, "admin")
+}
+
+func getUser(name string) (u userRecord, ok bool) {
+	tx, err := world.store.Begin(false)
+	if err != nil {
+		logrus.Errorf("get user: %v", err)
+		return u, false
+	}
+	defer tx.Rollback()
+	if bk := tx.Bucket([]byte("users")); bk != nil {
+		if v := bk.Get([]byte(name)); len(v) > 0 {
+			return u, u.unmarshal(v) == nil
+		}
+	}
+	return u, false
+}
+
+// putUser stores u, it fails if create is true and name has been registered.
+func putUser(name string, u userRecord, create bool) (bool, error) {
+	tx, err := world.store.Begin(true)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	bk, _ := tx.CreateBucketIfNotExists([]byte("users"))
+	if create && len(bk.Get([]byte(name))) > 0 {
+		return false, nil
+	}
+	bk.Put([]byte(name), u.marshal())
+	return true, tx.Commit()
+}
+
+// authToken proves the login of name until expire, changing the password
+// invalidates all tokens issued before.
+func authToken(name string, expire int64, u userRecord) string {
+	payload := name + "|" + strconv.FormatInt(expire, 10)
+	sig := hmacHex(payload + "|" + string(u.PassHash))
+	return base64.URLEncoding.EncodeToString([]byte(payload + "|" + sig))
+}
+
+func parseAuthToken(tok string) (string, bool) {
+	buf, err := base64.URLEncoding.DecodeString(tok)
+	if err != nil {
+		return "", false
+	}
+	parts := strings.Split(string(buf), "|")
+	if len(parts) != 3 {
+		return "", false
+	}
+	expire, _ := strconv.ParseInt(parts[1], 10, 64)
+	if expire < time.Now().Unix() {
+		return "", false
+	}
+	u, ok := getUser(parts[0])
+	if !ok {
+		return "", false
+	}
+	return parts[0], hmac.Equal([]byte(tok), []byte(authToken(parts[0], expire, u)))
+}
+
+func (c *Ctx) setAuthCookie(name string, u userRecord) {
+	c.User, c.Uid = name, name
+	c.SetUidCookie()
+
+	expire := time.Now().Unix() + authCookieAge
+	http.SetCookie(c.ResponseWriter, &http.Cookie{
+		Name:     "auth",
+		Value:    authToken(name, expire, u),
+		Expires:  time.Unix(expire, 0),
+		HttpOnly: true,
+		Path:     "/",
+	})
+}
+
+func handleLogin(c Ctx) {
+	var msg string
+	if c.Method == "POST" {
+		name := sanitizeStrict(c.FormValue("uid"), 20)
+		pass := c.FormValue("pass")
+		u, exists := getUser(name)
+		cooling := !c.CheckIP("~login")
+		c.AddIP("~login", time.Second)
+
+		switch op := c.FormValue("op"); {
+		case validateToken(c, c.FormValue("token")) != 1:
+			msg = "Invalid session"
+		case cooling:
+			msg = "Cooling down"
+		case len(name) < 2:
+			msg = "Nickname too short"
+		case len(pass) < 6 || len(pass) > 72:
+			msg = "Password must be 6 to 72 bytes"
+		case op == "register":
+			if !c.isAdmin() && reservedName(name) {
+				msg = "Nickname reserved"
+				break
+			}
+			if _, bot := getBot(name); bot {
+				msg = "Nickname already registered"
+				break
+			}
+			hash, _ := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+			u = userRecord{PassHash: hash, Created: time.Now().Unix()}
+			if ok, err := putUser(name, u, true); err != nil {
+				logrus.Errorf("register %s: %v", name, err)
+				msg = "Internal error"
+			} else if !ok {
+				msg = "Nickname already registered"
+			} else {
+				logrus.Infof("user %s registered from %v", name, c.IP)
+				c.setAuthCookie(name, u)
+				c.Redirect(302, "/")
+				return
+			}
+		case op == "password":
+			newPass := c.FormValue("newpass")
+			if !exists || bcrypt.CompareHashAndPassword(u.PassHash, []byte(pass)) != nil {
+				msg = "Wrong nickname or password"
+			} else if len(newPass) < 6 || len(newPass) > 72 {
+				msg = "Password must be 6 to 72 bytes"
+			} else {
+				u.PassHash, _ = bcrypt.GenerateFromPassword([]byte(newPass), bcrypt.DefaultCost)
+				if _, err := putUser(name, u, false); err != nil {
+					logrus.Errorf("change password %s: %v", name, err)
+					msg = "Internal error"
+					break
+				}
+				c.setAuthCookie(name, u)
+				c.Redirect(302, "/")
+				return
+			}
+		default:
+			if !exists || bcrypt.CompareHashAndPassword(u.PassHash, []byte(pass)) != nil {
+				msg = "Wrong nickname or password"
+				break
+			}
+			c.setAuthCookie(name, u)
+			c.Redirect(302, "/")
+			return
+		}
+	}
+
+	c.Template("login.html", map[string]any{
+		"uid":   c.Uid,
+		"user":  c.User,
+		"err":   msg,
+		"token": func() string { return makeToken(c) },
+	})
+}
+
+func handleLogout(c Ctx) {
+	if c.Method == "POST" && validateToken(c, c.FormValue("token")) == 1 {
+		c.User, c.Uid = "", ""
+		c.SetUidCookie()
+		http.SetCookie(c.ResponseWriter, &http.Cookie{
+			Name:    "auth",
+			Value:   "",
+			Expires: time.Unix(0, 0),
+			Path:    "/",
+		})
+	}
+	c.Redirect(302, "/")
+}
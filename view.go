@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"strconv"
+	"time"
+
+	"github.com/chai2010/webp"
+)
+
+const (
+	minScreenWidth = 320
+	maxScreenWidth = 1600
+	maxScale       = 2
+	tileHeight     = 120 // Logical height of the bands compared by delta frames
+	maxViews       = 32  // Rendered per refresh, other viewers get plain or default views
+)
+
+var screenHeight = 960
+var screenWidths = [...]int{400, 800} // Rendered even without viewers
+
+// view is everything a frame depends on besides the channel itself, viewers
+// with the same view share one rendered and encoded frame.
+type view struct {
+	width     int            // Logical width, frames are width*scale pixels wide
+	scale     int            // Device pixel ratio, 1 or 2
+	history   bool           // History pages have a date bar and no pins
+	collapsed bool           // One line pin strip
+	me        string         // Viewer mentioned on screen, whose rows are highlighted
+	loc       *time.Location // Timezone of timestamps, nil means the server's zone
+	theme     *theme
+}
+
+// view returns the preferred view of c from its query parameters and cookies.
+func (c Ctx) view() view {
+	width, _ := strconv.Atoi(c.Query.Get("screen"))
+	scale, _ := strconv.Atoi(c.Query.Get("scale"))
+	if scale < 1 || scale > maxScale {
+		scale = 1
+	}
+	return view{
+		width:     screenWidth(width),
+		scale:     scale,
+		collapsed: c.pinsCollapsed(),
+		loc:       c.timezone(),
+		theme:     c.theme(),
+	}
+}
+
+// screenWidth clamps w, rounding it to 10 pixels so similar screens share frames.
+func screenWidth(w int) int {
+	switch {
+	case w == 0:
+		return screenWidths[0]
+	case w < minScreenWidth:
+		return minScreenWidth
+	case w > maxScreenWidth:
+		return maxScreenWidth
+	}
+	return w / 10 * 10
+}
+
+// width returns the page width asked by ?w=, clamped like frame widths.
+func (c Ctx) width() int {
+	w, _ := strconv.Atoi(c.Query.Get("w"))
+	return screenWidth(w)
+}
+
+// plain returns v without options of individual viewers.
+func (v view) plain() view {
+	return view{width: v.width, scale: v.scale, theme: v.theme}
+}
+
+// view returns the view of o, options making no difference to data are
+// dropped so more viewers share the plain view.
+func (o *channelOnline) view(data []Message, pinned bool) view {
+	v := o.pref
+	v.collapsed = v.collapsed && pinned
+	if mentioned(data, o.uid) {
+		v.me = o.uid
+	}
+	return v
+}
+
+// frame is a view rendered by Refresh. Full frames are encoded for MJPEG
+// streams and new viewers, tiles for WebSocket viewers who asked for deltas.
+type frame struct {
+	full   bool // Encode the whole frame
+	delta  bool // Encode tiles changed since the last refresh
+	tiled  bool // Has delta viewers, only then hashes are computed
+	whole  bool // Most tiles changed, delta viewers get note instead
+	note   channelNotify
+	slide  []byte // Animated note.data scrolling from the last refresh
+	tiles  []tile
+	hashes []uint32    // Of every tile, see tileHashes
+	newest uint64      // ID of the newest message
+	img    *image.RGBA // Kept for slides only
+}
+
+// tile is a band of a frame starting at row y, in pixels.
+type tile struct {
+	y    int
+	data []byte
+}
+
+// tileHashes checksums img in bands of h rows.
+func tileHashes(img *image.RGBA, h int) (res []uint32) {
+	for y := 0; y < img.Rect.Dy(); y += h {
+		end := y + h
+		if end > img.Rect.Dy() {
+			end = img.Rect.Dy()
+		}
+		res = append(res, crc32.ChecksumIEEE(img.Pix[y*img.Stride:end*img.Stride]))
+	}
+	return res
+}
+
+// dirtyTiles returns indexes of tiles whose hashes differ from last, whole is
+// true if more than half of them did, then a full frame is sent instead.
+func dirtyTiles(hashes, last []uint32) (dirty []int, whole bool) {
+	for i, h := range hashes {
+		if i >= len(last) || last[i] != h {
+			dirty = append(dirty, i)
+		}
+	}
+	return dirty, len(dirty)*2 > len(hashes)
+}
+
+// renderViews renders data once for every view in frames, tiles and slides
+// start from frames of the last refresh in prev.
+func (ch *Channel) renderViews(frames map[view]*frame, prev map[view]*frame, data []Message, q int) {
+	var newest uint64
+	if len(data) > 0 {
+		newest = data[len(data)-1].ID
+	}
+	slides := *slide && webp.Native
+
+	for v, f := range frames {
+		img, _ := ch.render(v, data)
+		th := tileHeight * v.scale
+		f.newest = newest
+		if f.tiled {
+			f.hashes = tileHashes(img, th)
+		}
+		if slides {
+			f.img = img
+		}
+		last := prev[v]
+
+		var dirty []int
+		if f.delta {
+			var old []uint32
+			if last != nil {
+				old = last.hashes
+			}
+			dirty, f.whole = dirtyTiles(f.hashes, old)
+		}
+		if f.full || f.whole {
+			f.note = ch.encode(img, q)
+			if slides && f.note.mime == "image/webp" && last != nil && last.newest != newest {
+				f.slide = ch.encodeSlide(last.img, img, v, q)
+			}
+		}
+		if f.whole {
+			continue
+		}
+		for _, i := range dirty {
+			r := img.Rect
+			r.Min.Y = i * th
+			if r.Max.Y > r.Min.Y+th {
+				r.Max.Y = r.Min.Y + th
+			}
+			sub := img.SubImage(r).(*image.RGBA)
+			f.tiles = append(f.tiles, tile{y: r.Min.Y, data: ch.encode(sub, q).data})
+		}
+	}
+}
+
+// encode encodes img in -format, or JPEG while refreshes are slow.
+func (ch *Channel) encode(img *image.RGBA, q int) channelNotify {
+	if ch.degradeJPEG {
+		return encodeImage(img, "jpeg", q)
+	}
+	return encodeImage(img, *format, q)
+}
+
+// encodeImage encodes img as JPEG, PNG or by default WebP, which is lossy with
+// libwebp and lossless when built without cgo.
+func encodeImage(img image.Image, format string, q int) channelNotify {
+	out := bytes.Buffer{}
+	switch format {
+	case "jpeg":
+		jpeg.Encode(&out, img, &jpeg.Options{Quality: q})
+	case "png":
+		enc := png.Encoder{CompressionLevel: png.BestSpeed}
+		enc.Encode(&out, img)
+	default:
+		format = "webp"
+		webp.Encode(&out, img, &webp.Options{Quality: float32(q)})
+	}
+	return channelNotify{data: out.Bytes(), mime: "image/" + format}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"image"
+	"reflect"
+	"testing"
+)
+
+func TestTileHashes(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 10))
+	a := tileHashes(img, 4)
+	if len(a) != 3 { // The last band has 2 rows
+		t.Fatal(len(a))
+	}
+	if a[0] != a[1] || a[1] == a[2] {
+		t.Fatal(a)
+	}
+
+	img.Pix[img.PixOffset(3, 5)] = 1
+	b := tileHashes(img, 4)
+	if b[0] != a[0] || b[1] == a[1] || b[2] != a[2] {
+		t.Fatal(a, b)
+	}
+}
+
+func TestDirtyTiles(t *testing.T) {
+	for _, tc := range []struct {
+		hashes, last []uint32
+		dirty        []int
+		whole        bool
+	}{
+		{[]uint32{1, 2, 3, 4}, []uint32{1, 2, 3, 4}, nil, false},
+		{[]uint32{1, 2, 3, 4}, []uint32{1, 2, 0, 0}, []int{2, 3}, false},
+		{[]uint32{1, 2, 3, 4}, []uint32{0, 2, 0, 0}, []int{0, 2, 3}, true},
+		{[]uint32{1, 2, 3, 4}, []uint32{1, 2}, []int{2, 3}, false},
+		{[]uint32{1, 2, 3}, nil, []int{0, 1, 2}, true},
+	} {
+		dirty, whole := dirtyTiles(tc.hashes, tc.last)
+		if !reflect.DeepEqual(dirty, tc.dirty) || whole != tc.whole {
+			t.Fatalf("%v %v: %v %v", tc.hashes, tc.last, dirty, whole)
+		}
+	}
+}
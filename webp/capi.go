@@ -30,6 +30,7 @@ package webp
 import "C"
 import (
 	"errors"
+	"image"
 	"unsafe"
 )
 
@@ -307,6 +308,57 @@ func webpEncodeLosslessRGBA(exact int, pix []byte, width, height, stride int) (o
 	return
 }
 
+func webpEncodeAnimRGBA(frames []*image.RGBA, delays []int, loopCount int, quality float32, lossless bool) (output []byte, err error) {
+	if len(frames) == 0 || len(frames) != len(delays) || quality < 0.0 {
+		err = errors.New("webpEncodeAnimRGBA: bad arguments")
+		return
+	}
+	width, height := frames[0].Rect.Dx(), frames[0].Rect.Dy()
+	if width <= 0 || height <= 0 {
+		err = errors.New("webpEncodeAnimRGBA: bad arguments")
+		return
+	}
+
+	enc := C.webpAnimEncoderNew(C.int(width), C.int(height), C.int(loopCount))
+	if enc == nil {
+		err = errors.New("webpEncodeAnimRGBA: failed")
+		return
+	}
+	defer C.webpAnimEncoderDelete(enc)
+
+	var timestamp int
+	for i, m := range frames {
+		if m.Rect.Dx() != width || m.Rect.Dy() != height || delays[i] <= 0 {
+			err = errors.New("webpEncodeAnimRGBA: bad arguments")
+			return
+		}
+		var ll C.int
+		if lossless {
+			ll = 1
+		}
+		if C.webpAnimEncoderAdd(enc,
+			(*C.uint8_t)(unsafe.Pointer(&m.Pix[0])), C.int(width), C.int(height),
+			C.int(m.Stride), C.int(timestamp), C.float(quality), ll,
+		) == 0 {
+			err = errors.New("webpEncodeAnimRGBA: failed")
+			return
+		}
+		timestamp += delays[i]
+	}
+
+	var cptr_size C.size_t
+	var cptr = C.webpAnimEncoderAssemble(enc, C.int(timestamp), &cptr_size)
+	if cptr == nil || cptr_size == 0 {
+		err = errors.New("webpEncodeAnimRGBA: failed")
+		return
+	}
+	defer C.free(unsafe.Pointer(cptr))
+
+	output = make([]byte, int(cptr_size))
+	copy(output, ((*[1 << 30]byte)(unsafe.Pointer(cptr)))[0:len(output):len(output)])
+	return
+}
+
 func webpGetEXIF(data []byte) (metadata []byte, err error) {
 	if len(data) == 0 {
 		err = errors.New("webpGetEXIF: bad arguments")
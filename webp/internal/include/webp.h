@@ -68,6 +68,16 @@ uint8_t* webpEncodeLosslessRGBA(
 	size_t* output_size
 );
 
+// Animations are encoded by adding frames with increasing timestamps,
+// webpAnimEncoderAssemble ends the last frame at timestamp_ms.
+void* webpAnimEncoderNew(int width, int height, int loop_count);
+int webpAnimEncoderAdd(void* enc,
+	const uint8_t* rgba, int width, int height, int stride,
+	int timestamp_ms, float quality_factor, int lossless
+);
+uint8_t* webpAnimEncoderAssemble(void* enc, int timestamp_ms, size_t* output_size);
+void webpAnimEncoderDelete(void* enc);
+
 char* webpGetEXIF(const uint8_t* data, size_t data_size, size_t* metadata_size);
 char* webpGetICCP(const uint8_t* data, size_t data_size, size_t* metadata_size);
 char* webpGetXMP(const uint8_t* data, size_t data_size, size_t* metadata_size);
@@ -287,6 +287,54 @@ uint8_t* webpEncodeLosslessRGBA(
 	return wrt.mem;
 }
 
+void* webpAnimEncoderNew(int width, int height, int loop_count) {
+	WebPAnimEncoderOptions options;
+	if(!WebPAnimEncoderOptionsInit(&options)) {
+		return NULL;
+	}
+	options.anim_params.loop_count = loop_count;
+	return WebPAnimEncoderNew(width, height, &options);
+}
+
+int webpAnimEncoderAdd(void* enc,
+	const uint8_t* rgba, int width, int height, int stride,
+	int timestamp_ms, float quality_factor, int lossless
+) {
+	WebPPicture pic;
+	WebPConfig config;
+	int ok;
+
+	if(!WebPConfigPreset(&config, WEBP_PRESET_DEFAULT, quality_factor) || !WebPPictureInit(&pic)) {
+		return 0;
+	}
+	config.lossless = lossless;
+
+	pic.use_argb = 1;
+	pic.width = width;
+	pic.height = height;
+
+	ok = WebPPictureImportRGBA(&pic, rgba, stride) &&
+		WebPAnimEncoderAdd((WebPAnimEncoder*)enc, &pic, timestamp_ms, &config);
+	WebPPictureFree(&pic);
+	return ok;
+}
+
+uint8_t* webpAnimEncoderAssemble(void* enc, int timestamp_ms, size_t* output_size) {
+	WebPData output_data = {NULL, 0};
+	*output_size = 0;
+	if(!WebPAnimEncoderAdd((WebPAnimEncoder*)enc, NULL, timestamp_ms, NULL) ||
+		!WebPAnimEncoderAssemble((WebPAnimEncoder*)enc, &output_data)) {
+		WebPDataClear(&output_data);
+		return NULL;
+	}
+	*output_size = output_data.size;
+	return (uint8_t*)(output_data.bytes);
+}
+
+void webpAnimEncoderDelete(void* enc) {
+	WebPAnimEncoderDelete((WebPAnimEncoder*)enc);
+}
+
 char* webpGetEXIF(const uint8_t* data, size_t data_size, size_t* metadata_size) {
 	char* metadata = NULL;
 	WebPData webp_data = {data, data_size};
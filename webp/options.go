@@ -0,0 +1,23 @@
+// Copyright 2014 <chaishushan{AT}gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webp
+
+import "image"
+
+const DefaulQuality = 90
+
+// Options are the encoding parameters.
+type Options struct {
+	Lossless bool
+	Quality  float32 // 0 ~ 100
+	Exact    bool    // Preserve RGB values in transparent area.
+}
+
+// Animation is an animated WEBP image, see image/gif.GIF.
+type Animation struct {
+	Image     []image.Image // Frames of the same size
+	Delay     []int         // Milliseconds each frame is shown
+	LoopCount int           // 0 loops forever
+}
@@ -0,0 +1,437 @@
+// Copyright 2014 <chaishushan{AT}gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webp
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"math/bits"
+	"sort"
+)
+
+// A minimal lossless (VP8L) encoder in pure Go, used when cgo is disabled.
+// It applies the subtract green transform and LZ77 with copies from the left
+// pixel, the pixel above and the last position of a hashed run of pixels,
+// with one group of canonical prefix codes for the whole image.
+
+const (
+	vp8lMaxSize      = 1 << 14
+	vp8lMaxLength    = 4096
+	vp8lMaxDistance  = 1<<20 - 120
+	vp8lMinLength    = 3
+	vp8lHashBits     = 16
+	vp8lNumLiterals  = 256
+	vp8lNumLengths   = 24
+	vp8lNumDistances = 40
+	vp8lMaxCodeLen   = 15
+	vp8lMaxCLCodeLen = 7
+)
+
+var vp8lCodeLengthOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+type vp8lWriter struct {
+	buf  []byte
+	acc  uint64
+	nacc uint
+}
+
+func (w *vp8lWriter) writeBits(v uint32, n uint) {
+	w.acc |= uint64(v) << w.nacc
+	w.nacc += n
+	for w.nacc >= 8 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc >>= 8
+		w.nacc -= 8
+	}
+}
+
+func (w *vp8lWriter) flush() []byte {
+	if w.nacc > 0 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc, w.nacc = 0, 0
+	}
+	return w.buf
+}
+
+// vp8lCode is a canonical prefix code, symbols with zero length are unused.
+// A code with a single used symbol takes no bits.
+type vp8lCode struct {
+	lengths []uint8
+	codes   []uint16 // Bit reversed, as written LSB first
+	single  bool
+}
+
+func (w *vp8lWriter) writeSymbol(c *vp8lCode, sym int) {
+	if !c.single {
+		w.writeBits(uint32(c.codes[sym]), uint(c.lengths[sym]))
+	}
+}
+
+// newVP8LCode builds a code of at most limit bits for the histogram.
+func newVP8LCode(hist []uint32, limit int) *vp8lCode {
+	c := &vp8lCode{lengths: make([]uint8, len(hist)), codes: make([]uint16, len(hist))}
+	var used []int
+	for sym, n := range hist {
+		if n > 0 {
+			used = append(used, sym)
+		}
+	}
+	switch len(used) {
+	case 0:
+		c.single = true
+		return c
+	case 1:
+		c.lengths[used[0]] = 1
+		c.single = true
+		return c
+	}
+
+	for min := uint32(1); ; min *= 2 {
+		counts := make([]uint32, len(used))
+		for i, sym := range used {
+			counts[i] = hist[sym]
+			if counts[i] < min {
+				counts[i] = min
+			}
+		}
+		depths := huffmanDepths(counts)
+		ok := true
+		for i, d := range depths {
+			if d > limit {
+				ok = false
+				break
+			}
+			c.lengths[used[i]] = uint8(d)
+		}
+		if ok {
+			break
+		}
+	}
+
+	// Canonical codes, shorter codes and smaller symbols first.
+	var count [vp8lMaxCodeLen + 1]int
+	for _, l := range c.lengths {
+		count[l]++
+	}
+	count[0] = 0
+	var next [vp8lMaxCodeLen + 2]int
+	for l, code := 1, 0; l <= vp8lMaxCodeLen; l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+	for sym, l := range c.lengths {
+		if l > 0 {
+			code := next[l]
+			next[l]++
+			c.codes[sym] = uint16(bits.Reverse16(uint16(code)) >> (16 - l))
+		}
+	}
+	return c
+}
+
+// huffmanDepths returns the depth of each leaf of the Huffman tree of counts.
+func huffmanDepths(counts []uint32) []int {
+	type node struct {
+		count       uint64
+		left, right int // -1 for leaves
+	}
+	nodes := make([]node, 0, len(counts)*2)
+	order := make([]int, len(counts))
+	for i, n := range counts {
+		nodes = append(nodes, node{count: uint64(n), left: -1, right: -1})
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return counts[order[i]] < counts[order[j]] })
+
+	// Two queues: sorted leaves and internal nodes, which are created in
+	// increasing order of count.
+	leaves, internal := order, []int{}
+	pop := func() int {
+		if len(internal) == 0 || (len(leaves) > 0 && nodes[leaves[0]].count <= nodes[internal[0]].count) {
+			n := leaves[0]
+			leaves = leaves[1:]
+			return n
+		}
+		n := internal[0]
+		internal = internal[1:]
+		return n
+	}
+	for len(leaves)+len(internal) > 1 {
+		a, b := pop(), pop()
+		nodes = append(nodes, node{count: nodes[a].count + nodes[b].count, left: a, right: b})
+		internal = append(internal, len(nodes)-1)
+	}
+
+	depths := make([]int, len(counts))
+	var walk func(n, depth int)
+	walk = func(n, depth int) {
+		if nodes[n].left < 0 {
+			depths[n] = depth
+			return
+		}
+		walk(nodes[n].left, depth+1)
+		walk(nodes[n].right, depth+1)
+	}
+	walk(len(nodes)-1, 0)
+	return depths
+}
+
+// writeCode writes the code lengths of c, as a simple code if possible.
+func (w *vp8lWriter) writeCode(c *vp8lCode) {
+	var used []int
+	for sym, l := range c.lengths {
+		if l > 0 {
+			used = append(used, sym)
+		}
+	}
+	if len(used) == 0 {
+		used = append(used, 0)
+	}
+	if len(used) <= 2 && used[len(used)-1] < 256 {
+		w.writeBits(1, 1) // Simple code
+		w.writeBits(uint32(len(used)-1), 1)
+		if used[0] <= 1 {
+			w.writeBits(0, 1)
+			w.writeBits(uint32(used[0]), 1)
+		} else {
+			w.writeBits(1, 1)
+			w.writeBits(uint32(used[0]), 8)
+		}
+		if len(used) == 2 {
+			w.writeBits(uint32(used[1]), 8)
+		}
+		return
+	}
+
+	// Run length encoded lengths, written with the code length code.
+	type token struct{ sym, extra, n uint32 }
+	var tokens []token
+	for i := 0; i < len(c.lengths); {
+		l := c.lengths[i]
+		run := 1
+		for i+run < len(c.lengths) && c.lengths[i+run] == l {
+			run++
+		}
+		i += run
+		if l == 0 {
+			for run >= 11 {
+				r := run
+				if r > 138 {
+					r = 138
+				}
+				tokens = append(tokens, token{18, uint32(r - 11), 7})
+				run -= r
+			}
+			if run >= 3 {
+				tokens = append(tokens, token{17, uint32(run - 3), 3})
+				run = 0
+			}
+		} else {
+			tokens = append(tokens, token{uint32(l), 0, 0})
+			run--
+			for run >= 3 {
+				r := run
+				if r > 6 {
+					r = 6
+				}
+				tokens = append(tokens, token{16, uint32(r - 3), 2})
+				run -= r
+			}
+		}
+		for ; run > 0; run-- {
+			tokens = append(tokens, token{uint32(l), 0, 0})
+		}
+	}
+
+	hist := make([]uint32, len(vp8lCodeLengthOrder))
+	for _, t := range tokens {
+		hist[t.sym]++
+	}
+	clc := newVP8LCode(hist, vp8lMaxCLCodeLen)
+	n := len(vp8lCodeLengthOrder)
+	for n > 4 && clc.lengths[vp8lCodeLengthOrder[n-1]] == 0 {
+		n--
+	}
+	w.writeBits(0, 1) // Normal code
+	w.writeBits(uint32(n-4), 4)
+	for _, sym := range vp8lCodeLengthOrder[:n] {
+		w.writeBits(uint32(clc.lengths[sym]), 3)
+	}
+	w.writeBits(0, 1) // All symbols
+	for _, t := range tokens {
+		w.writeSymbol(clc, int(t.sym))
+		w.writeBits(t.extra, uint(t.n))
+	}
+}
+
+// vp8lPrefix splits a length or distance code into its prefix symbol and
+// extra bits.
+func vp8lPrefix(v int) (sym int, extra uint32, n uint) {
+	d := v - 1
+	if d < 4 {
+		return d, 0, 0
+	}
+	h := bits.Len(uint(d)) - 1
+	second := (d >> (h - 1)) & 1
+	n = uint(h - 1)
+	return 2*h + second, uint32(d) & (1<<n - 1), n
+}
+
+// vp8lDistanceCode maps a distance to the code of the neighbourhood table,
+// only the pixel above and the left one are looked up.
+func vp8lDistanceCode(dist, width int) int {
+	switch dist {
+	case width:
+		return 1
+	case 1:
+		return 2
+	}
+	return dist + 120
+}
+
+type vp8lToken struct {
+	argb   uint32
+	length int // Copy if not 0
+	dist   int // Distance code
+}
+
+func vp8lMatch(pix []uint32, i, j int) int {
+	n := 0
+	for i+n < len(pix) && n < vp8lMaxLength && pix[i+n] == pix[j+n] {
+		n++
+	}
+	return n
+}
+
+// encodeVP8L encodes m as a lossless WEBP.
+func encodeVP8L(m *image.RGBA) ([]byte, error) {
+	width, height := m.Rect.Dx(), m.Rect.Dy()
+	if width <= 0 || height <= 0 || width > vp8lMaxSize || height > vp8lMaxSize {
+		return nil, errors.New("webp: bad image size for lossless encoding")
+	}
+
+	// ARGB with green subtracted from red and blue.
+	pix := make([]uint32, 0, width*height)
+	opaque := true
+	for y := 0; y < height; y++ {
+		row := m.Pix[y*m.Stride : y*m.Stride+width*4]
+		for x := 0; x < len(row); x += 4 {
+			r, g, b, a := row[x], row[x+1], row[x+2], row[x+3]
+			opaque = opaque && a == 255
+			pix = append(pix, uint32(a)<<24|uint32(r-g)<<16|uint32(g)<<8|uint32(b-g))
+		}
+	}
+
+	var tokens []vp8lToken
+	hash := make([]int32, 1<<vp8lHashBits)
+	for i := range hash {
+		hash[i] = -1
+	}
+	hashAt := func(i int) uint32 {
+		h := pix[i]*0x1e35a7bd ^ pix[i+1]*0x9e3779b1 ^ pix[i+2]
+		return (h * 0x1e35a7bd) >> (32 - vp8lHashBits)
+	}
+	for i := 0; i < len(pix); {
+		length, dist := 0, 0
+		if i >= 1 {
+			length, dist = vp8lMatch(pix, i, i-1), 1
+		}
+		if i >= width {
+			if n := vp8lMatch(pix, i, i-width); n > length {
+				length, dist = n, width
+			}
+		}
+		if i+2 < len(pix) {
+			h := hashAt(i)
+			if j := int(hash[h]); j >= 0 && i-j <= vp8lMaxDistance {
+				if n := vp8lMatch(pix, i, j); n > length {
+					length, dist = n, i-j
+				}
+			}
+			hash[h] = int32(i)
+		}
+		if length < vp8lMinLength {
+			tokens = append(tokens, vp8lToken{argb: pix[i]})
+			i++
+			continue
+		}
+		tokens = append(tokens, vp8lToken{length: length, dist: vp8lDistanceCode(dist, width)})
+		for k := i + 1; k < i+length && k+2 < len(pix); k += 4 {
+			hash[hashAt(k)] = int32(k)
+		}
+		i += length
+	}
+
+	green := make([]uint32, vp8lNumLiterals+vp8lNumLengths)
+	red := make([]uint32, vp8lNumLiterals)
+	blue := make([]uint32, vp8lNumLiterals)
+	alpha := make([]uint32, vp8lNumLiterals)
+	dists := make([]uint32, vp8lNumDistances)
+	for _, t := range tokens {
+		if t.length == 0 {
+			green[t.argb>>8&0xff]++
+			red[t.argb>>16&0xff]++
+			blue[t.argb&0xff]++
+			alpha[t.argb>>24]++
+		} else {
+			sym, _, _ := vp8lPrefix(t.length)
+			green[vp8lNumLiterals+sym]++
+			sym, _, _ = vp8lPrefix(t.dist)
+			dists[sym]++
+		}
+	}
+	codes := [5]*vp8lCode{
+		newVP8LCode(green, vp8lMaxCodeLen),
+		newVP8LCode(red, vp8lMaxCodeLen),
+		newVP8LCode(blue, vp8lMaxCodeLen),
+		newVP8LCode(alpha, vp8lMaxCodeLen),
+		newVP8LCode(dists, vp8lMaxCodeLen),
+	}
+
+	w := &vp8lWriter{}
+	w.writeBits(0x2f, 8)
+	w.writeBits(uint32(width-1), 14)
+	w.writeBits(uint32(height-1), 14)
+	if opaque {
+		w.writeBits(0, 1)
+	} else {
+		w.writeBits(1, 1)
+	}
+	w.writeBits(0, 3) // Version
+	w.writeBits(1, 1) // Transform
+	w.writeBits(2, 2) // Subtract green
+	w.writeBits(0, 1) // No more transforms
+	w.writeBits(0, 1) // No color cache
+	w.writeBits(0, 1) // No meta prefix codes
+	for _, c := range codes {
+		w.writeCode(c)
+	}
+	for _, t := range tokens {
+		if t.length == 0 {
+			w.writeSymbol(codes[0], int(t.argb>>8&0xff))
+			w.writeSymbol(codes[1], int(t.argb>>16&0xff))
+			w.writeSymbol(codes[2], int(t.argb&0xff))
+			w.writeSymbol(codes[3], int(t.argb>>24))
+			continue
+		}
+		sym, extra, n := vp8lPrefix(t.length)
+		w.writeSymbol(codes[0], vp8lNumLiterals+sym)
+		w.writeBits(extra, n)
+		sym, extra, n = vp8lPrefix(t.dist)
+		w.writeSymbol(codes[4], sym)
+		w.writeBits(extra, n)
+	}
+	data := w.flush()
+
+	size := len(data) + len(data)&1
+	out := make([]byte, 20+size)
+	copy(out, "RIFF")
+	binary.LittleEndian.PutUint32(out[4:], uint32(12+size))
+	copy(out[8:], "WEBPVP8L")
+	binary.LittleEndian.PutUint32(out[16:], uint32(len(data)))
+	copy(out[20:], data)
+	return out, nil
+}
@@ -0,0 +1,73 @@
+// Copyright 2014 <chaishushan{AT}gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webp
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+	"math/rand"
+	"testing"
+
+	xwebp "golang.org/x/image/webp"
+)
+
+func tVP8LRoundTrip(t *testing.T, name string, m *image.RGBA) int {
+	data, err := encodeVP8L(m)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	got, err := xwebp.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("%s: decode: %v", name, err)
+	}
+	// Pix is stored as is, like libwebp does.
+	n, ok := got.(*image.NRGBA)
+	if !ok || n.Rect.Size() != m.Rect.Size() {
+		t.Fatalf("%s: got %T of %v, want %v", name, got, got.Bounds(), m.Rect.Size())
+	}
+	w := m.Rect.Dx() * 4
+	for y := 0; y < m.Rect.Dy(); y++ {
+		r0, r1 := m.Pix[y*m.Stride:y*m.Stride+w], n.Pix[y*n.Stride:y*n.Stride+w]
+		if !bytes.Equal(r0, r1) {
+			t.Fatalf("%s: row %d differs", name, y)
+		}
+	}
+	return len(data)
+}
+
+func TestEncodeVP8L(t *testing.T) {
+	for _, name := range []string{"1_webp_ll.png", "2_webp_ll.png", "3_webp_ll.png", "4_webp_ll.png", "5_webp_ll.png", "video-001.png"} {
+		m, err := loadImage(name)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		rgba := image.NewRGBA(m.Bounds())
+		draw.Draw(rgba, rgba.Bounds(), m, m.Bounds().Min, draw.Src)
+		tVP8LRoundTrip(t, name, rgba)
+	}
+
+	// Flat areas with text like rows, long copies and a sub image.
+	m := image.NewRGBA(image.Rect(0, 0, 300, 200))
+	draw.Draw(m, m.Bounds(), image.White, image.Point{}, draw.Src)
+	rnd := rand.New(rand.NewSource(1))
+	for y := 20; y < 180; y += 20 {
+		for x := 10; x < 290; x++ {
+			if rnd.Intn(3) == 0 {
+				m.Set(x, y+rnd.Intn(10), image.Black)
+			}
+		}
+	}
+	if n := tVP8LRoundTrip(t, "rows", m); n > 300*200 {
+		t.Fatalf("rows: %d bytes, copies are not used", n)
+	}
+	tVP8LRoundTrip(t, "sub", m.SubImage(image.Rect(7, 13, 107, 77)).(*image.RGBA))
+
+	for _, size := range []image.Point{{1, 1}, {1, 5}, {5, 1}, {3, 3}} {
+		m := image.NewRGBA(image.Rectangle{Max: size})
+		rnd.Read(m.Pix)
+		tVP8LRoundTrip(t, "tiny", m)
+	}
+}
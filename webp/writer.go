@@ -15,14 +15,8 @@ import (
 	"reflect"
 )
 
-const DefaulQuality = 90
-
-// Options are the encoding parameters.
-type Options struct {
-	Lossless bool
-	Quality  float32 // 0 ~ 100
-	Exact    bool    // Preserve RGB values in transparent area.
-}
+// Native reports whether libwebp is linked, see writer_purego.go otherwise.
+const Native = true
 
 type colorModeler interface {
 	ColorModel() color.Model
@@ -94,6 +88,25 @@ func encode(w io.Writer, m image.Image, opt *Options) (err error) {
 	return
 }
 
+// EncodeAll writes the frames of anim to w as an animated WEBP. Options apply
+// to every frame, Exact is ignored.
+func EncodeAll(w io.Writer, anim *Animation, opt *Options) (err error) {
+	quality, lossless := float32(DefaulQuality), false
+	if opt != nil {
+		quality, lossless = opt.Quality, opt.Lossless
+	}
+	frames := make([]*image.RGBA, len(anim.Image))
+	for i, m := range anim.Image {
+		frames[i] = toRGBAImage(m)
+	}
+	output, err := webpEncodeAnimRGBA(frames, anim.Delay, anim.LoopCount, quality, lossless)
+	if err != nil {
+		return
+	}
+	_, err = w.Write(output)
+	return
+}
+
 func adjustImage(m image.Image) image.Image {
 	if p, ok := AsMemPImage(m); ok {
 		switch {
@@ -0,0 +1,64 @@
+// Copyright 2014 <chaishushan{AT}gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !cgo
+// +build !cgo
+
+package webp
+
+import (
+	"errors"
+	"image"
+	"image/draw"
+	"io"
+	"os"
+
+	xwebp "golang.org/x/image/webp"
+)
+
+// Native reports whether libwebp is linked. Without it images are always
+// encoded lossless by encodeVP8L and animations are not supported.
+const Native = false
+
+var errNoAnimation = errors.New("webp: animations need cgo")
+
+func Save(name string, m image.Image, opt *Options) (err error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return Encode(f, m, opt)
+}
+
+// Encode writes the image m to w in lossless WEBP format, opt is ignored.
+func Encode(w io.Writer, m image.Image, opt *Options) (err error) {
+	p, ok := m.(*image.RGBA)
+	if !ok {
+		p = image.NewRGBA(m.Bounds())
+		draw.Draw(p, p.Rect, m, p.Rect.Min, draw.Src)
+	}
+	output, err := encodeVP8L(p)
+	if err != nil {
+		return
+	}
+	_, err = w.Write(output)
+	return
+}
+
+// EncodeAll always fails without cgo.
+func EncodeAll(w io.Writer, anim *Animation, opt *Options) error {
+	return errNoAnimation
+}
+
+// Decode reads a WEBP image from r, see golang.org/x/image/webp.
+func Decode(r io.Reader) (image.Image, error) {
+	return xwebp.Decode(r)
+}
+
+// DecodeConfig returns the size of a WEBP image from r.
+func DecodeConfig(r io.Reader) (image.Config, error) {
+	return xwebp.DecodeConfig(r)
+}
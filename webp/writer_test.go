@@ -2,11 +2,18 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
+//go:build cgo
+// +build cgo
+
 package webp
 
 import (
 	"bytes"
+	"encoding/binary"
+	"image"
+	"image/draw"
 	_ "image/png"
+	"reflect"
 	"testing"
 )
 
@@ -104,3 +111,51 @@ func TestEncode(t *testing.T) {
 		}
 	}
 }
+
+func TestEncodeAll(t *testing.T) {
+	anim := &Animation{Delay: []int{40, 40, 1000}, LoopCount: 1}
+	for i := range anim.Delay {
+		m := image.NewRGBA(image.Rect(0, 0, 64, 48))
+		draw.Draw(m, m.Bounds(), image.White, image.Point{}, draw.Src)
+		draw.Draw(m, image.Rect(0, 40-i*16, 64, 48-i*16), image.Black, image.Point{}, draw.Src)
+		anim.Image = append(anim.Image, m)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := EncodeAll(buf, anim, &Options{Lossless: true}); err != nil {
+		t.Fatal(err)
+	}
+	p := buf.Bytes()
+	if len(p) < 12 || string(p[:4]) != "RIFF" || string(p[8:12]) != "WEBP" {
+		t.Fatalf("bad header %q", p)
+	}
+
+	var delays []int
+	var loop = -1
+	for p = p[12:]; len(p) >= 8; {
+		id, n := string(p[:4]), int(binary.LittleEndian.Uint32(p[4:8]))
+		chunk := p[8 : 8+n]
+		switch id {
+		case "VP8X":
+			if chunk[0]&0x02 == 0 {
+				t.Fatal("animation flag not set")
+			}
+		case "ANIM":
+			loop = int(binary.LittleEndian.Uint16(chunk[4:6]))
+		case "ANMF":
+			delays = append(delays, int(chunk[12])|int(chunk[13])<<8|int(chunk[14])<<16)
+		}
+		p = p[8+n+n&1:]
+	}
+	if loop != anim.LoopCount {
+		t.Fatalf("loop count: got %d, want %d", loop, anim.LoopCount)
+	}
+	if !reflect.DeepEqual(delays, anim.Delay) {
+		t.Fatalf("delays: got %v, want %v", delays, anim.Delay)
+	}
+
+	anim.Image[1] = image.NewRGBA(image.Rect(0, 0, 32, 32))
+	if err := EncodeAll(buf, anim, nil); err == nil {
+		t.Fatal("frames of different sizes are encoded")
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	wsBinary = 2
+	wsClose  = 8
+	wsPing   = 9
+	wsPong   = 10
+
+	wsMaxPayload = 4096
+	wsGUID       = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+var (
+	errWSHandshake = errors.New("bad websocket handshake")
+	errWSFrame     = errors.New("bad websocket frame")
+	errWSOrigin    = errors.New("websocket origin not allowed")
+)
+
+// wsConn is a minimal RFC 6455 server side connection. Frames from clients
+// are only read for control purposes, payloads larger than wsMaxPayload are
+// rejected.
+type wsConn struct {
+	net.Conn
+	br *bufio.Reader
+	mu sync.Mutex
+}
+
+func isWebSocket(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+func wsAccept(key string) string {
+	h := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// sameOrigin reports whether the Origin header matches host. Browsers always
+// send it, so an empty one is from other clients and allowed.
+func sameOrigin(origin, host string) bool {
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, host)
+}
+
+func upgradeWebSocket(c Ctx) (*wsConn, error) {
+	key := c.Request.Header.Get("Sec-WebSocket-Key")
+	if key == "" || c.Request.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, errWSHandshake
+	}
+	if !sameOrigin(c.Request.Header.Get("Origin"), c.Request.Host) {
+		return nil, errWSOrigin
+	}
+	hijack, _ := c.ResponseWriter.(http.Hijacker)
+	if hijack == nil {
+		return nil, errWSHandshake
+	}
+	conn, rw, err := hijack.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", wsAccept(key))
+	return &wsConn{Conn: conn, br: rw.Reader}, nil
+}
+
+// WriteFrame writes an unfragmented frame, it is safe for concurrent use.
+func (ws *wsConn) WriteFrame(op byte, p []byte) error {
+	hdr := []byte{0x80 | op}
+	switch n := len(p); {
+	case n < 126:
+		hdr = append(hdr, byte(n))
+	case n <= 0xFFFF:
+		hdr = binary.BigEndian.AppendUint16(append(hdr, 126), uint16(n))
+	default:
+		hdr = binary.BigEndian.AppendUint64(append(hdr, 127), uint64(n))
+	}
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.SetWriteDeadline(time.Now().Add(time.Second * 5))
+	bufs := net.Buffers{hdr, p}
+	_, err := bufs.WriteTo(ws.Conn)
+	return err
+}
+
+// ReadFrame reads a frame sent by the client, fragments are returned as is.
+func (ws *wsConn) ReadFrame() (op byte, p []byte, err error) {
+	var hdr [14]byte
+	if _, err := io.ReadFull(ws.br, hdr[:2]); err != nil {
+		return 0, nil, err
+	}
+	op = hdr[0] & 0xF
+	if hdr[1]&0x80 == 0 {
+		return 0, nil, errWSFrame // Client frames must be masked
+	}
+
+	n := uint64(hdr[1] & 0x7F)
+	switch n {
+	case 126:
+		if _, err := io.ReadFull(ws.br, hdr[2:4]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(hdr[2:4]))
+	case 127:
+		if _, err := io.ReadFull(ws.br, hdr[2:10]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(hdr[2:10])
+	}
+	if n > wsMaxPayload {
+		return 0, nil, errWSFrame
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(ws.br, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	p = make([]byte, n)
+	if _, err := io.ReadFull(ws.br, p); err != nil {
+		return 0, nil, err
+	}
+	for i := range p {
+		p[i] ^= mask[i&3]
+	}
+	return op, p, nil
+}
+
+// writeLast sends img as the last binary frame before closing.
+func (ws *wsConn) writeLast(img []byte) {
+	ws.WriteFrame(wsBinary, img)
+	ws.WriteFrame(wsClose, nil)
+}
+
+// writeErrorImage responds with an image showing msg, as a single binary frame
+// if c is a WebSocket handshake.
+func (c Ctx) writeErrorImage(msg string) {
+	img := makeErrorImage(c.view(), msg)
+	if isWebSocket(c.Request) {
+		if ws, err := upgradeWebSocket(c); err == nil {
+			ws.writeLast(img)
+			ws.Close()
+		}
+		return
+	}
+	c.ResponseWriter.Header().Add("Content-Type", "image/jpeg")
+	c.Write(img)
+}
+
+// tileMessage is a binary message of delta clients: the row img is drawn at as
+// 2 bytes big endian, then the WebP or JPEG image. Full frames start at row 0.
+func tileMessage(y int, img []byte) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(y)), img...)
+}
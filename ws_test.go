@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestWSAccept(t *testing.T) {
+	// Example from RFC 6455 section 1.3.
+	if v := wsAccept("dGhlIHNhbXBsZSBub25jZQ=="); v != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatal(v)
+	}
+}
+
+func TestSameOrigin(t *testing.T) {
+	for _, tc := range []struct {
+		origin, host string
+		ok           bool
+	}{
+		{"", "chat.example.com", true},
+		{"https://chat.example.com", "chat.example.com", true},
+		{"http://Chat.Example.com:8888", "chat.example.com:8888", true},
+		{"https://evil.example.com", "chat.example.com", false},
+		{"https://chat.example.com:8443", "chat.example.com", false},
+		{"null", "chat.example.com", false},
+	} {
+		if sameOrigin(tc.origin, tc.host) != tc.ok {
+			t.Fatalf("%q %q: expect %v", tc.origin, tc.host, tc.ok)
+		}
+	}
+}
+
+func TestWSReadFrame(t *testing.T) {
+	mask := []byte{1, 2, 3, 4}
+	masked := func(hdr []byte, p []byte) []byte {
+		out := append(append([]byte{}, hdr...), mask...)
+		for i, b := range p {
+			out = append(out, b^mask[i&3])
+		}
+		return out
+	}
+	long := bytes.Repeat([]byte("x"), 300)
+
+	for _, tc := range []struct {
+		in  []byte
+		op  byte
+		p   []byte
+		bad bool
+	}{
+		{in: masked([]byte{0x89, 0x82}, []byte("hi")), op: wsPing, p: []byte("hi")},
+		{in: masked([]byte{0x8A, 0x80}, nil), op: wsPong, p: []byte{}},
+		{in: masked([]byte{0x82, 0x80 | 126, 1, 44}, long), op: wsBinary, p: long},
+		{in: []byte{0x89, 0x02, 'h', 'i'}, bad: true},
+		{in: []byte{0x82, 0x80 | 127, 0, 0, 0, 0, 0, 1, 0, 0}, bad: true},
+		{in: masked([]byte{0x89, 0x85}, []byte("hi")), bad: true},
+	} {
+		ws := &wsConn{br: bufio.NewReader(bytes.NewReader(tc.in))}
+		op, p, err := ws.ReadFrame()
+		if tc.bad {
+			if err == nil {
+				t.Fatalf("%x: expect error", tc.in)
+			}
+			continue
+		}
+		if err != nil || op != tc.op || !bytes.Equal(p, tc.p) {
+			t.Fatalf("%x: %v %v %q", tc.in, err, op, p)
+		}
+	}
+}
+
+func TestWSWriteFrame(t *testing.T) {
+	for _, n := range []int{0, 125, 126, 0xFFFF, 0x10000} {
+		a, b := net.Pipe()
+		go func() {
+			(&wsConn{Conn: a}).WriteFrame(wsBinary, make([]byte, n))
+			a.Close()
+		}()
+		var buf bytes.Buffer
+		buf.ReadFrom(b)
+		hdr := 2
+		if n >= 126 {
+			hdr += 2
+		}
+		if n > 0xFFFF {
+			hdr += 6
+		}
+		if buf.Len() != hdr+n || buf.Bytes()[0] != 0x82 {
+			t.Fatalf("%d: %d %x", n, buf.Len(), buf.Bytes()[0])
+		}
+	}
+}
+
+func TestTileMessage(t *testing.T) {
+	p := tileMessage(0x1234, []byte("img"))
+	if !bytes.Equal(p, []byte{0x12, 0x34, 'i', 'm', 'g'}) {
+		t.Fatalf("%x", p)
+	}
+	if p := tileMessage(0, nil); !bytes.Equal(p, []byte{0, 0}) {
+		t.Fatalf("%x", p)
+	}
+}